@@ -1,6 +1,7 @@
 package OasisAPI
 
 import (
+	"database/sql"
 	"io"
 	"time"
 )
@@ -10,6 +11,8 @@ type Server interface {
 	PluginManager
 	CommandManager
 	TaskManager
+	LogReader
+	MetricsManager
 	GetCreateTime() time.Time
 	RunningTime() time.Duration
 }
@@ -19,8 +22,51 @@ type ConsolePrinter interface {
 	ClearFormatter()
 }
 
+// LogEntry is a structured log entry
+type LogEntry struct {
+	Time    time.Time
+	Level   string
+	Plugin  string // empty if logged by server
+	Message string
+	Caller  string // empty if DebugMode is off
+	Fields  map[string]interface{}
+}
+
+// LogQuery filters entries in log files.
+// Zero value of a field means no filter.
+type LogQuery struct {
+	Plugin  string    // only entries logged by the plugin
+	Level   string    // minimum level: debug, info, warn, error
+	Pattern string    // regular expression matching message or fields
+	Since   time.Time // only entries after the time
+	Limit   int       // only the last Limit entries
+}
+
+type LogReader interface {
+	// QueryLogs reads the current and rotated log files,
+	// and returns matched entries in time order.
+	QueryLogs(LogQuery) ([]LogEntry, error)
+	// RecentLogs returns the last n entries kept in memory,
+	// all of them if n <= 0.
+	RecentLogs(n int) []LogEntry
+	// SubscribeLogs delivers new entries matching the query to the
+	// subscription. Since and Limit are ignored. Entries are dropped
+	// instead of blocking loggers if the buffer is full.
+	SubscribeLogs(q LogQuery, buffer int) (LogSubscription, error)
+}
+
+type LogSubscription interface {
+	C() <-chan LogEntry
+	// Dropped returns how many entries are dropped for a full buffer
+	Dropped() uint64
+	// Close should be called in OnDisable, C will be closed
+	Close()
+}
+
 type Formatter interface {
-	Format(b string) string
+	// Format is called before an entry is printed to console.
+	// Entry is a copy only printed to console, it can be modified here.
+	Format(*LogEntry)
 }
 
 type CommandEntry struct {
@@ -72,6 +118,33 @@ type TaskManager interface {
 	UnregisterTask(int)
 }
 
+// MetricsManager registers metrics exported in Prometheus text format.
+// Metrics of a plugin are named oasis_plugin_<plugin>_<name>.
+// Registering an existing name returns the registered one.
+type MetricsManager interface {
+	NewCounter(p Plugin, name string, help string, labels ...string) Counter
+	NewGauge(p Plugin, name string, help string, labels ...string) Gauge
+	NewSummary(p Plugin, name string, help string, labels ...string) Summary
+	UnregisterPluginMetrics(Plugin)
+}
+
+// label values must be given in the order of labels when registered
+
+type Counter interface {
+	Inc(labelValues ...string)
+	Add(v float64, labelValues ...string)
+}
+
+type Gauge interface {
+	Set(v float64, labelValues ...string)
+	Add(v float64, labelValues ...string)
+}
+
+// Summary records the count and sum of observations
+type Summary interface {
+	Observe(v float64, labelValues ...string)
+}
+
 type PluginManager interface {
 	GetPlugin(string) Plugin
 	//GetPlugins equals GetEnabledPlugins
@@ -79,6 +152,7 @@ type PluginManager interface {
 	GetEnabledPlugins() []Plugin
 	GetDisabledPlugins() []Plugin
 	GetAllPlugins() []Plugin
+	GetPluginsByState(PluginState) []Plugin
 	LoadPlugin(...string)
 	LoadPlugins()
 }
@@ -93,10 +167,58 @@ type Plugin interface {
 	GetAuthor() string
 	IsEnabled() bool
 	IsLoaded() bool
+	// IsFailed reports whether a lifecycle hook of the plugin
+	// failed, panicked or timed out, GetFailure returns the reason
+	IsFailed() bool
+	GetFailure() string
+	GetPluginState() PluginState
+	// GetStateHistory returns the recent state transitions, the oldest first
+	GetStateHistory() []PluginTransition
 	GetDetailedInfo() string
 	GetPluginAPI() interface{}
 	GetDependencies() []PluginDependency
 	GetSoftDependencies() []PluginDependency
+	GetHealth() Health
+}
+
+type PluginState string
+
+const (
+	PluginDiscovered PluginState = "discovered"
+	PluginLoaded     PluginState = "loaded"
+	PluginEnabling   PluginState = "enabling"
+	PluginEnabled    PluginState = "enabled"
+	PluginDisabling  PluginState = "disabling"
+	PluginDisabled   PluginState = "disabled"
+	PluginFailed     PluginState = "failed"
+	PluginUnloaded   PluginState = "unloaded"
+)
+
+type PluginTransition struct {
+	From   PluginState
+	To     PluginState
+	Time   time.Time
+	Reason string
+}
+
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded"
+	HealthFailing  HealthStatus = "failing"
+	HealthUnknown  HealthStatus = "unknown"
+)
+
+type Health struct {
+	Status  HealthStatus
+	Message string
+}
+
+// HealthChecker can be implemented by UserPlugin.
+// CheckHealth is called every HealthInterval while enabled.
+type HealthChecker interface {
+	CheckHealth() Health
 }
 
 type UserPlugin interface {
@@ -113,6 +235,17 @@ type PluginProperty interface {
 	GetServer() Server
 	GetLogger() Logger
 	GetConfig() Configuration
+	// OpenConfig opens an additional config file of the plugin, e.g.
+	// "messages.yml" or "data.json". The format is decided by extension,
+	// and the server's ConfigType is used if there isn't one.
+	// The same Configuration is returned if the file is opened twice.
+	OpenConfig(file string, defaultFields ...map[string]interface{}) (Configuration, error)
+	// GetStorage returns the key-value storage of the plugin,
+	// stored in storage.db in the plugin folder
+	GetStorage() (Storage, error)
+	// GetDatabase returns the database of the plugin, which is
+	// migrated when enabled and closed when disabled
+	GetDatabase() (*sql.DB, error)
 	GetFolder() string
 }
 
@@ -181,6 +314,11 @@ type PluginDescription struct {
 	Dependencies        []PluginDependency
 	SoftDependencies    []PluginDependency
 	DefaultConfigFields map[string]interface{}
+	ConfigMigrations    []ConfigMigration
+	DatabaseMigrations  []DatabaseMigration
+	// ConfigType is the format of the plugin config file.
+	// Empty means the server's ConfigType
+	ConfigType string
 }
 
 type PluginDependency struct {
@@ -0,0 +1,14 @@
+package OasisAPI
+
+// MigrationTable records migrations applied to a plugin database
+const MigrationTable = "oasis_migrations"
+
+// DatabaseMigration is a SQL migration of the plugin database.
+// Migrations are applied in order of Version when the plugin is enabled,
+// each one in a transaction, and applied versions are recorded in the
+// table oasis_migrations. Versions mustn't be changed once released.
+type DatabaseMigration struct {
+	Version     int
+	Description string
+	SQL         string
+}
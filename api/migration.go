@@ -0,0 +1,75 @@
+package OasisAPI
+
+import "strings"
+
+// ConfigMigration migrates a config tree from version From to version To.
+// When the "Version" in config file is older than the default one,
+// migrations are applied in order of From. If any of them returns an error,
+// the config file is kept untouched.
+type ConfigMigration struct {
+	From    string
+	To      string
+	Migrate func(ConfigTree) error
+}
+
+// ConfigTree is the raw content of a config file.
+// Keys are case-insensitive and nested keys are separated by "."
+type ConfigTree map[string]interface{}
+
+func (t ConfigTree) search(key string, create bool) (map[string]interface{}, string) {
+	path := strings.Split(strings.ToLower(key), ".")
+	m := map[string]interface{}(t)
+	for _, k := range path[:len(path)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil, ""
+			}
+			next = map[string]interface{}{}
+			m[k] = next
+		}
+		m = next
+	}
+	return m, path[len(path)-1]
+}
+
+// Get returns the value of key and whether it exists
+func (t ConfigTree) Get(key string) (interface{}, bool) {
+	m, k := t.search(key, false)
+	if m == nil {
+		return nil, false
+	}
+	v, ok := m[k]
+	return v, ok
+}
+
+// Set sets the value of key, creating parent keys if necessary
+func (t ConfigTree) Set(key string, value interface{}) {
+	m, k := t.search(key, true)
+	m[k] = value
+}
+
+// Delete returns false if key doesn't exist
+func (t ConfigTree) Delete(key string) bool {
+	m, k := t.search(key, false)
+	if m == nil {
+		return false
+	}
+	if _, ok := m[k]; !ok {
+		return false
+	}
+	delete(m, k)
+	return true
+}
+
+// Move renames or moves key from to key to.
+// It returns false if from doesn't exist
+func (t ConfigTree) Move(from string, to string) bool {
+	v, ok := t.Get(from)
+	if !ok {
+		return false
+	}
+	t.Delete(from)
+	t.Set(to, v)
+	return true
+}
@@ -0,0 +1,35 @@
+package OasisAPI
+
+import (
+	"fmt"
+	"sync"
+)
+
+var registryLock sync.Mutex
+var registry []UserPlugin
+
+// Register compiles a plugin into the server binary instead of loading it
+// from a .so file. It should be called in init() of the plugin package,
+// which is blank imported by the server. It panics if the name is empty
+// or already registered.
+func Register(up UserPlugin) {
+	name := up.GetDescription().Name
+	if name == "" {
+		panic("oasis: Register plugin with empty name")
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, p := range registry {
+		if p.GetDescription().Name == name {
+			panic(fmt.Sprintf("oasis: Register called twice for plugin %s", name))
+		}
+	}
+	registry = append(registry, up)
+}
+
+// RegisteredPlugins returns plugins registered in order of registration
+func RegisteredPlugins() []UserPlugin {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	return append([]UserPlugin{}, registry...)
+}
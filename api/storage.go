@@ -0,0 +1,36 @@
+package OasisAPI
+
+import "time"
+
+// Storage is a durable key-value store of a plugin.
+// Keys are grouped in buckets, which are created on first write.
+type Storage interface {
+	// Bucket returns a bucket whose every operation
+	// runs in its own transaction
+	Bucket(name string) Bucket
+	Buckets() ([]string, error)
+	DeleteBucket(name string) error
+	// Update runs f in a read-write transaction. Changes are
+	// committed if f returns nil, or rolled back otherwise.
+	Update(f func(StorageTx) error) error
+	// View runs f in a read-only transaction
+	View(f func(StorageTx) error) error
+}
+
+// StorageTx is a transaction, which can't be used after
+// the function passed to Update or View returned
+type StorageTx interface {
+	Bucket(name string) Bucket
+}
+
+type Bucket interface {
+	// Get returns nil if key doesn't exist or is expired
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	// PutTTL puts a key expiring after ttl
+	PutTTL(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	// ForEach calls f with keys having the prefix in order, until f
+	// returns an error. f mustn't write to the storage unless in Update.
+	ForEach(prefix string, f func(key string, value []byte) error) error
+}
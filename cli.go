@@ -0,0 +1,423 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	goplugin "plugin"
+	"runtime"
+	"sort"
+	"strings"
+
+	. "github.com/spf13/viper"
+	. "github.com/xaxys/oasis/api"
+)
+
+const cliUsage = `Usage: oasis [command] [flags]
+
+Commands:
+  run                      Run the server, the default command
+  plugins list             List plugin files without running them
+  plugins list --builtin   List plugins compiled in
+  plugins verify [file]    Check plugin files and their dependencies
+  plugins info <file>      Show description of a plugin file
+  config init              Write default config files
+  version                  Show version
+
+Run "oasis <command> -h" for flags of a command.`
+
+// headless disables the interactive console, e.g. under systemd or Docker
+var headless bool
+
+// serverConfigDir is the folder of server and plugin manager config
+var serverConfigDir = "."
+var serverConfigType = "yml"
+
+// runCLI runs the command in args and returns the exit code
+func runCLI(args []string) int {
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "run":
+		return runServer(args)
+	case "plugins", "plugin":
+		return runPluginsCommand(args)
+	case "config":
+		return runConfigCommand(args)
+	case "version":
+		fmt.Printf("Oasis %s %s %s/%s\n", OasisVersion, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return 0
+	case "help":
+		fmt.Println(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s\n", command, cliUsage)
+		return 2
+	}
+}
+
+// configOverrides collects repeated "--set scope.key=value"
+type configOverrides struct{}
+
+func (configOverrides) String() string {
+	return ""
+}
+
+func (configOverrides) Set(kv string) error {
+	pair := strings.SplitN(kv, "=", 2)
+	if len(pair) != 2 || !strings.Contains(pair[0], ".") {
+		return fmt.Errorf("should be like --set server.LogLevel=debug")
+	}
+	flagOverrides[strings.ToLower(pair[0])] = pair[1]
+	return nil
+}
+
+// setServerConfigFile uses file as server config, and
+// plugin manager config is put in the same folder
+func setServerConfigFile(file string) error {
+	ext := filepath.Ext(file)
+	configType := strings.TrimPrefix(ext, ".")
+	if err := checkConfigType(configType); err != nil {
+		return err
+	}
+	serverConfigDir = filepath.Dir(file)
+	serverConfigType = configType
+	ServerConfigName = strings.TrimSuffix(filepath.Base(file), ext)
+	return nil
+}
+
+func runServer(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	config := fs.String("config", "", "server config `file`, ./server.yml by default")
+	plugins := fs.String("plugins", "", "plugin `folder`, overrides PluginPath")
+	data := fs.String("data", "", "plugin resource `folder`, overrides PluginResourcePath")
+	configDir := fs.String("config-dir", "", "plugin config `folder`, overrides ConfigPath")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error, overrides LogLevel")
+	pidfile := fs.String("pidfile", "", "pidfile `path`, overrides PidFile")
+	watch := fs.Bool("watch", false, "load new plugin files in PluginPath, overrides WatchPlugins")
+	fs.BoolVar(&headless, "headless", false, "run without the interactive console")
+	fs.Var(configOverrides{}, "set", "override a config, e.g. server.LogLevel=debug. Repeatable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *config != "" {
+		if err := setServerConfigFile(*config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	for key, value := range map[string]string{
+		"server.pluginpath":         *plugins,
+		"server.pluginresourcepath": *data,
+		"server.configpath":         *configDir,
+		"server.loglevel":           *logLevel,
+		"server.pidfile":            *pidfile,
+	} {
+		if value != "" {
+			flagOverrides[key] = value
+		}
+	}
+	if *watch {
+		flagOverrides["server.watchplugins"] = "true"
+	}
+
+	// pidfile is acquired before configs and logs are written,
+	// so that another instance won't touch the data folder
+	pf, err := acquirePidFile(getPidFilePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to acquire pidfile. Details: %v\n", err)
+		return 1
+	}
+	defer pf.Release()
+
+	initServerConfig()
+	startSignalHandler()
+	myserver := getServer()
+
+	if !headless {
+		startReader()
+	}
+	myserver.LoadPlugins()
+	startPluginWatcher()
+	notifyState("READY=1\nSTATUS=Running")
+	stopWatchdog := make(chan struct{})
+	startWatchdog(stopWatchdog)
+	myserver.Wait()
+	close(stopWatchdog)
+	return myserver.ExitCode()
+}
+
+// offlineServerConfig reads server config without creating or watching it
+func offlineServerConfig(file string) *Viper {
+	v := New()
+	for key, value := range serverConfigDefault {
+		v.SetDefault(key, value)
+	}
+	v.SetConfigFile(file)
+	v.ReadInConfig()
+	return v
+}
+
+// openPluginFile opens a plugin file without loading it
+func openPluginFile(file string) (*oasisPlugin, error) {
+	gp, err := goplugin.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid go plugin. Details: %v", err)
+	}
+	p, err := NewPlugin(gp)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid oasis plugin. Details: %v", err)
+	}
+	return p, nil
+}
+
+func runPluginsCommand(args []string) int {
+	fs := flag.NewFlagSet("plugins", flag.ContinueOnError)
+	config := fs.String("config", "server.yml", "server config `file` to find PluginPath")
+	plugins := fs.String("plugins", "", "plugin `folder`, overrides PluginPath")
+	builtin := fs.Bool("builtin", false, "list or show plugins compiled in instead of plugin files")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: oasis plugins list|verify [file...]|info <file...> [flags]")
+		fmt.Fprintln(fs.Output(), "       oasis plugins list|info --builtin [name...]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	sub := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *builtin {
+		return runBuiltinPluginsCommand(sub, fs.Args())
+	}
+	path := *plugins
+	if path == "" {
+		path = offlineServerConfig(*config).GetString("PluginPath")
+	}
+
+	var files []string
+	for _, name := range fs.Args() {
+		if _, err := os.Stat(name); err != nil {
+			name = filepath.Join(path, name)
+		}
+		files = append(files, name)
+	}
+	if len(files) == 0 && sub != "info" {
+		matches, _ := filepath.Glob(filepath.Join(path, "*.so"))
+		files = matches
+	}
+
+	switch sub {
+	case "l", "list":
+		fmt.Printf("Found %d plugin files in %s:\n", len(files), path)
+		for _, file := range files {
+			if p, err := openPluginFile(file); err != nil {
+				fmt.Printf("%s\t[invalid] %v\n", filepath.Base(file), err)
+			} else {
+				fmt.Printf("%s\t[%s] %s\n", filepath.Base(file), p, p.GetDescription())
+			}
+		}
+		return 0
+	case "v", "verify":
+		return verifyPluginFiles(files)
+	case "i", "info":
+		if len(files) == 0 {
+			fs.Usage()
+			return 2
+		}
+		code := 0
+		for _, file := range files {
+			p, err := openPluginFile(file)
+			if err != nil {
+				fmt.Printf("%s: %v\n", file, err)
+				code = 1
+				continue
+			}
+			printPluginFileInfo(file, p)
+		}
+		return code
+	default:
+		fs.Usage()
+		return 2
+	}
+}
+
+// runBuiltinPluginsCommand lists or shows plugins registered by api.Register
+func runBuiltinPluginsCommand(sub string, names []string) int {
+	plugins := map[string]*oasisPlugin{}
+	var list []*oasisPlugin
+	for _, up := range RegisteredPlugins() {
+		p, err := newPlugin(up, nil)
+		if err != nil {
+			continue
+		}
+		plugins[p.GetName()] = p
+		list = append(list, p)
+	}
+
+	switch sub {
+	case "l", "list":
+		fmt.Printf("Found %d built-in plugins:\n", len(list))
+		for _, p := range list {
+			fmt.Printf("[%s] %s\n", p, p.GetDescription())
+		}
+		return 0
+	case "i", "info":
+		code := 0
+		for _, name := range names {
+			p, ok := plugins[name]
+			if !ok {
+				fmt.Printf("%s: built-in plugin is not found\n", name)
+				code = 1
+				continue
+			}
+			printPluginFileInfo("[builtin]", p)
+		}
+		return code
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: oasis plugins list|info --builtin [name...]")
+		return 2
+	}
+}
+
+// verifyPluginFiles checks that files are valid plugins with unique
+// names, and their dependencies are satisfied by each other and
+// plugins compiled in
+func verifyPluginFiles(files []string) int {
+	plugins := map[string]*oasisPlugin{}
+	fileOf := map[string]string{}
+	code := 0
+	for _, up := range RegisteredPlugins() {
+		if p, err := newPlugin(up, nil); err == nil {
+			plugins[p.GetName()] = p
+			fileOf[p.GetName()] = "[builtin]"
+		}
+	}
+	for _, file := range files {
+		p, err := openPluginFile(file)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			code = 1
+			continue
+		}
+		if other, ok := fileOf[p.GetName()]; ok {
+			fmt.Printf("FAIL %s: plugin %s is also in %s\n", file, p.GetName(), other)
+			code = 1
+			continue
+		}
+		plugins[p.GetName()] = p
+		fileOf[p.GetName()] = file
+	}
+
+	var names []string
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := plugins[name]
+		var problems []string
+		for _, d := range p.GetDependencies() {
+			dp, ok := plugins[d.Name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("dependency %s is not found", d.Name))
+			} else if !Compare(dp.GetVersion(), d.Version, d.Comparator) {
+				problems = append(problems, fmt.Sprintf("dependency %s version%s%s is not satisfied by [%s]", d.Name, d.Comparator, d.Version, dp))
+			}
+		}
+		if len(problems) > 0 {
+			fmt.Printf("FAIL %s [%s]: %s\n", fileOf[name], p, strings.Join(problems, "; "))
+			code = 1
+		} else {
+			fmt.Printf("OK   %s [%s]\n", fileOf[name], p)
+		}
+	}
+	return code
+}
+
+func printPluginFileInfo(file string, p *oasisPlugin) {
+	_, healthChecker := p.UserPlugin.(HealthChecker)
+	fmt.Printf(`
+	[Plugin File]: %s
+		[Name]: %s
+		[Version]: %s
+		[Author]: %s
+		[Description]: %s
+		[Dependencies]: %s
+		[SoftDependencies]: %s
+		[ConfigType]: %s
+		[ConfigMigrations]: %d
+		[DatabaseMigrations]: %d
+		[HealthChecker]: %v
+`,
+		file,
+		p.Name,
+		p.Version,
+		p.Author,
+		p.Description,
+		formatDependencies(p.Dependencies),
+		formatDependencies(p.SoftDependencies),
+		p.PluginDescription.ConfigType,
+		len(p.ConfigMigrations),
+		len(p.DatabaseMigrations),
+		healthChecker)
+}
+
+func formatDependencies(list []PluginDependency) string {
+	var s []string
+	for _, d := range list {
+		s = append(s, fmt.Sprintf("%s version%s%s", d.Name, d.Comparator, d.Version))
+	}
+	return strings.Join(s, ", ")
+}
+
+func runConfigCommand(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	config := fs.String("config", "server.yml", "server config `file` to write")
+	force := fs.Bool("force", false, "overwrite existing config files")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: oasis config init [flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "init" {
+		fs.Usage()
+		return 2
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if err := setServerConfigFile(*config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	code := 0
+	files := map[string]map[string]interface{}{
+		*config: serverConfigDefault,
+		filepath.Join(serverConfigDir, PluginManagerConfigName+"."+serverConfigType): pluginManagerConfigDefault,
+	}
+	for file, defaults := range files {
+		if _, err := os.Stat(file); err == nil && !*force {
+			fmt.Printf("Config %s exists, use --force to overwrite it\n", file)
+			code = 1
+			continue
+		}
+		v := New()
+		for key, value := range defaults {
+			v.Set(key, value)
+		}
+		if err := v.WriteConfigAs(file); err != nil {
+			fmt.Printf("Failed to write config %s. Details: %v\n", file, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("Config %s written\n", file)
+	}
+	return code
+}
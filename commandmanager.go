@@ -17,7 +17,10 @@ const PredictionThreshold = 10
 var commandManagerLock sync.Mutex
 var commandManager *oasisCommandManager
 
+// oasisCommandManager guards commandMap and pluginMap with lock,
+// commands are excuted without holding it
 type oasisCommandManager struct {
+	lock       sync.RWMutex
 	commandMap *trie
 	pluginMap  map[Plugin]map[string]*trieNode
 }
@@ -46,12 +49,6 @@ func (cm *oasisCommandManager) ExcuteCommand(caller CommandCaller, sentence stri
 		return false
 	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			getLogger().Errorf("Recovered from panic: %v", r)
-		}
-	}()
-
 	var callerName string
 	var p Plugin = nil
 	if _, ok := caller.(ConsoleCaller); ok {
@@ -72,23 +69,36 @@ func (cm *oasisCommandManager) ExcuteCommand(caller CommandCaller, sentence stri
 
 	getLogger().Infof("%s issued command: %s", callerName, sentence)
 
+	cm.lock.RLock()
 	c, ok := cm.commandMap.Get(command)
+	cm.lock.RUnlock()
 	if ok {
-		c.OnCommand(p, command, args)
+		if c.Plugin != nil && !c.Plugin.IsEnabled() {
+			getLogger().Infof("Command: %s is disabled with plugin [%s].", command, c.Plugin)
+			return false
+		}
+		getMetricsManager().commands.Inc(command, callerName)
+		if guard(c.Plugin, "command "+command, func() { c.OnCommand(p, command, args) }) {
+			getMetricsManager().commandErrors.Inc(command, "panic")
+		}
 		return true
 	} else {
 		getLogger().Infof("Command: %s is not found.", command)
+		getMetricsManager().commandErrors.Inc(command, "not_found")
 		return false
 	}
 }
 
 func (cm *oasisCommandManager) RegisterCommand(command string, p Plugin, ce CommandExcutor) bool {
 	command = strings.ToLower(command)
+	p = pluginKey(p)
 	c := &CommandEntry{
 		Command:        command,
 		Plugin:         p,
 		CommandExcutor: ce,
 	}
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
 	node, ok := cm.commandMap.Insert(c)
 	if ok {
 		if cm.pluginMap[p] == nil {
@@ -101,6 +111,9 @@ func (cm *oasisCommandManager) RegisterCommand(command string, p Plugin, ce Comm
 	}
 }
 func (cm *oasisCommandManager) UnregisterCommand(command string) bool {
+	command = strings.ToLower(command)
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
 	c, ok := cm.commandMap.Delete(command)
 	if ok {
 		delete(cm.pluginMap[c.Plugin], command)
@@ -110,6 +123,9 @@ func (cm *oasisCommandManager) UnregisterCommand(command string) bool {
 	}
 }
 func (cm *oasisCommandManager) UnregisterPluginCommand(p Plugin) {
+	p = pluginKey(p)
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
 	for _, v := range cm.pluginMap[p] {
 		v.content = nil
 		cm.commandMap.Update(v)
@@ -117,6 +133,8 @@ func (cm *oasisCommandManager) UnregisterPluginCommand(p Plugin) {
 	delete(cm.pluginMap, p)
 }
 func (cm *oasisCommandManager) GetPrediction(command string, force bool) (int, []CommandEntry) {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
 	num := cm.commandMap.Count(command)
 	if num > PredictionThreshold && !force || num == 0 {
 		return num, nil
@@ -127,6 +145,9 @@ func (cm *oasisCommandManager) GetPrediction(command string, force bool) (int, [
 	}
 }
 func (cm *oasisCommandManager) GetPluginCommands(p Plugin) []CommandEntry {
+	p = pluginKey(p)
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
 	var list []CommandEntry
 	if cm.pluginMap[p] != nil {
 		for _, v := range cm.pluginMap[p] {
@@ -255,6 +276,8 @@ func (t *trie) contents(node *trieNode) []CommandEntry {
 	for _, v := range node.children {
 		list = append(list, t.contents(v)...)
 	}
-	list = append(list, *node.content)
+	if node.content != nil {
+		list = append(list, *node.content)
+	}
 	return list
 }
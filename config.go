@@ -2,19 +2,68 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	. "github.com/spf13/viper"
 	. "github.com/xaxys/oasis/api"
 )
 
-const ConfigPath = "./configs"
+const DefaultConfigPath = "./configs"
+
+// ConfigTypes are the supported config file formats
+var ConfigTypes = []string{"yml", "yaml", "json", "toml", "hcl", "ini"}
+
+// EnvPrefix is the prefix of environment variables overriding configs.
+// e.g. OASIS_SERVER_LOGLEVEL, OASIS_PLUGIN_<NAME>_<KEY>
+const EnvPrefix = "OASIS"
+
+// Origins of a config value, from the lowest priority to the highest
+const (
+	OriginDefault = "default"
+	OriginFile    = "file"
+	OriginEnv     = "env"
+	OriginFlag    = "flag"
+	OriginRuntime = "runtime"
+)
+
+var configsLock sync.Mutex
+var configs = map[string]*oasisConfiguration{}
+
+// flagOverrides holds values from command-line "--set scope.key=value"
+var flagOverrides = map[string]string{}
 
 type oasisConfiguration struct {
 	*Viper
-	handles []func()
-	lock sync.Mutex
+	scope    string
+	owner    Plugin
+	handles  []func()
+	origins  map[string]string
+	shadowed map[string]interface{}
+	defaults *Viper
+	written  []byte
+	lock     sync.Mutex
+
+	viperLock sync.RWMutex // guards Viper
+}
+
+func (c *oasisConfiguration) Set(key string, value interface{}) {
+	key = strings.ToLower(key)
+	c.lock.Lock()
+	if c.origins == nil {
+		c.origins = map[string]string{}
+	}
+	c.origins[key] = OriginRuntime
+	delete(c.shadowed, key)
+	c.lock.Unlock()
+	c.setViper(key, value)
 }
 
 func (c *oasisConfiguration) SetAndWrite(key string, value interface{}) error {
@@ -25,18 +74,115 @@ func (c *oasisConfiguration) SetAndWrite(key string, value interface{}) error {
 	return nil
 }
 
-func (c *oasisConfiguration) UnmarshalKey(key string, rawVal interface{}) error {
-	return c.Viper.UnmarshalKey(key, rawVal)
+// WriteConfig writes current config to file, but values overridden by
+// environment variables or command-line flags are written as they were
+// in file, so that secrets won't be leaked into config files.
+func (c *oasisConfiguration) WriteConfig() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	filename := c.ConfigFileUsed()
+	if len(c.shadowed) == 0 || filename == "" {
+		c.viperLock.RLock()
+		err := c.Viper.WriteConfig()
+		c.viperLock.RUnlock()
+		if err != nil {
+			return err
+		}
+	} else {
+		v := New()
+		for _, key := range c.AllKeys() {
+			if value, ok := c.shadowed[key]; ok {
+				if value != nil {
+					v.Set(key, value)
+				}
+			} else {
+				v.Set(key, c.Get(key))
+			}
+		}
+		if err := v.WriteConfigAs(filename); err != nil {
+			return err
+		}
+	}
+	for key, origin := range c.origins {
+		if origin == OriginRuntime {
+			delete(c.origins, key)
+		}
+	}
+	// Remember what we wrote to tell our own writes from file changes
+	c.written, _ = ioutil.ReadFile(c.ConfigFileUsed())
+	return nil
 }
 
-func (c *oasisConfiguration) Unmarshal(rawVal interface{}) error {
-	return c.Viper.Unmarshal(rawVal)
+// isSelfWritten returns true if the config file is the same as
+// what WriteConfig wrote last time
+func (c *oasisConfiguration) isSelfWritten() bool {
+	// WriteConfig holds the lock while writing
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b, err := ioutil.ReadFile(c.ConfigFileUsed())
+	if err == nil && c.written != nil && string(b) == string(c.written) {
+		return true
+	}
+	c.written = nil
+	return false
 }
 
-func (c *oasisConfiguration) SubConfig(key string) Configuration {
-	return &oasisConfiguration{
-		Viper: c.Sub(key),
+// setInFile sets key in the config file and reads it again. Unlike Set,
+// the value can still be changed by editing the file later.
+func (c *oasisConfiguration) setInFile(key string, value interface{}) error {
+	c.lock.Lock()
+	filename := c.ConfigFileUsed()
+	v := New()
+	v.SetConfigFile(filename)
+	if err := v.ReadInConfig(); err != nil && !os.IsNotExist(err) {
+		c.lock.Unlock()
+		return err
 	}
+	v.Set(key, value)
+	if err := v.WriteConfigAs(filename); err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	c.written, _ = ioutil.ReadFile(filename)
+	c.lock.Unlock()
+	return c.ReadInConfig()
+}
+
+// reload reads the config file again and runs handles
+func (c *oasisConfiguration) reload() error {
+	if err := c.ReadInConfig(); err != nil {
+		return err
+	}
+	getLogger().Infof("Config %s reloaded", c.scope)
+	getMetricsManager().configReloads.Inc(c.scope)
+	c.runHandles()
+	return nil
+}
+
+// runHandles calls handles added by AddHandle
+func (c *oasisConfiguration) runHandles() {
+	c.lock.Lock()
+	handles := append([]func(){}, c.handles...)
+	c.lock.Unlock()
+	for _, f := range handles {
+		guard(c.owner, "config handle of "+c.scope, f)
+	}
+}
+
+// GetDefault returns the default value of key, nil if there isn't one
+func (c *oasisConfiguration) GetDefault(key string) interface{} {
+	if c.defaults == nil {
+		return nil
+	}
+	return c.defaults.Get(key)
+}
+
+// DefaultKeys returns all keys having a default value
+func (c *oasisConfiguration) DefaultKeys() []string {
+	if c.defaults == nil {
+		return nil
+	}
+	return c.defaults.AllKeys()
 }
 
 func (c *oasisConfiguration) AddHandle(f func()) {
@@ -51,6 +197,167 @@ func (c *oasisConfiguration) RemoveAllHandle(f func()) {
 	c.lock.Unlock()
 }
 
+// GetOrigin returns where the effective value of key comes from
+func (c *oasisConfiguration) GetOrigin(key string) string {
+	key = strings.ToLower(key)
+	c.lock.Lock()
+	origin, ok := c.origins[key]
+	c.lock.Unlock()
+	if ok {
+		return origin
+	}
+	if c.InConfig(key) {
+		return OriginFile
+	}
+	return OriginDefault
+}
+
+// applyOverrides overrides config values by environment variables and
+// command-line flags. Environment variable with a "_FILE" suffix is
+// treated as a path to the file containing the value.
+func (c *oasisConfiguration) applyOverrides() {
+	prefix := EnvPrefix + "_" + envName(c.scope) + "_"
+	for _, key := range c.AllKeys() {
+		env := prefix + envName(key)
+		if value, ok := os.LookupEnv(env); ok {
+			c.override(key, value, OriginEnv)
+		} else if file, ok := os.LookupEnv(env + "_FILE"); ok {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				getLogger().Warnf("Failed to read %s_FILE for config %s. Details: %v", env, c.scope, err)
+				continue
+			}
+			c.override(key, strings.TrimRight(string(b), "\r\n"), OriginEnv)
+		}
+	}
+	for k, value := range flagOverrides {
+		if key := strings.TrimPrefix(k, c.scope+"."); key != k {
+			c.override(key, value, OriginFlag)
+		}
+	}
+}
+
+func (c *oasisConfiguration) override(key string, value interface{}, origin string) {
+	c.lock.Lock()
+	if c.origins == nil {
+		c.origins = map[string]string{}
+	}
+	if c.shadowed == nil {
+		c.shadowed = map[string]interface{}{}
+	}
+	if _, ok := c.shadowed[key]; !ok && c.InConfig(key) {
+		c.shadowed[key] = c.Get(key)
+	} else if !ok {
+		c.shadowed[key] = nil
+	}
+	c.origins[key] = origin
+	c.lock.Unlock()
+	c.setViper(key, value)
+}
+
+func envName(s string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_", " ", "_", "/", "__").Replace(s))
+}
+
+// getConfigPath returns the root folder of plugin configs
+func getConfigPath() string {
+	if path := ServerConfig.GetString("ConfigPath"); path != "" {
+		return path
+	}
+	return DefaultConfigPath
+}
+
+func checkConfigType(configType string) error {
+	for _, v := range ConfigTypes {
+		if v == configType {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported config type %s, should be one of %v", configType, ConfigTypes)
+}
+
+func getConfig(scope string) *oasisConfiguration {
+	configsLock.Lock()
+	defer configsLock.Unlock()
+	return configs[strings.ToLower(scope)]
+}
+
+// findConfig finds config by scope or by plugin name
+func findConfig(name string) *oasisConfiguration {
+	if c := getConfig(name); c != nil {
+		return c
+	}
+	return getConfig("plugin." + name)
+}
+
+// parseConfigValue parses s into the type of old
+func parseConfigValue(old interface{}, s string) (interface{}, error) {
+	switch old.(type) {
+	case bool:
+		return strconv.ParseBool(s)
+	case int, int8, int16, int32, int64:
+		i, err := strconv.ParseInt(s, 0, 64)
+		return int(i), err
+	case uint, uint8, uint16, uint32, uint64:
+		i, err := strconv.ParseUint(s, 0, 64)
+		return uint(i), err
+	case float32, float64:
+		return strconv.ParseFloat(s, 64)
+	case time.Duration:
+		return time.ParseDuration(s)
+	case []interface{}, []string:
+		var list []string
+		for _, v := range strings.Split(s, ",") {
+			list = append(list, strings.TrimSpace(v))
+		}
+		return list, nil
+	case map[string]interface{}, map[interface{}]interface{}:
+		return nil, fmt.Errorf("can't set a map, set its keys instead")
+	default:
+		return s, nil
+	}
+}
+
+// flushConfigs writes configs changed by Set but not written yet
+func flushConfigs() {
+	configsLock.Lock()
+	var list []*oasisConfiguration
+	for _, c := range configs {
+		list = append(list, c)
+	}
+	configsLock.Unlock()
+	for _, c := range list {
+		if c.isDirty() {
+			if err := c.WriteConfig(); err != nil {
+				getLogger().Warnf("Failed to write config %s. Details: %v", c.scope, err)
+			}
+		}
+	}
+}
+
+// isDirty returns true if some values are Set but not written
+func (c *oasisConfiguration) isDirty() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, origin := range c.origins {
+		if origin == OriginRuntime {
+			return true
+		}
+	}
+	return false
+}
+
+func getConfigScopes() []string {
+	var list []string
+	configsLock.Lock()
+	for k := range configs {
+		list = append(list, k)
+	}
+	configsLock.Unlock()
+	sort.Strings(list)
+	return list
+}
+
 func NewConfig(file string, defaultFields ...map[string]interface{}) Configuration {
 	var c Configuration
 	err, updated := InitConfig(&c, file, defaultFields...)
@@ -66,24 +373,56 @@ func NewConfig(file string, defaultFields ...map[string]interface{}) Configurati
 	return c
 }
 
+// newPluginConfig returns a *ConfigMigrationError if the config file
+// can't be migrated, otherwise errors are only logged.
+func newPluginConfig(name string, configType string, migrations []ConfigMigration, defaultFields ...map[string]interface{}) (Configuration, error) {
+	if configType == "" {
+		configType = ServerConfig.GetString("ConfigType")
+	}
+	var c Configuration
+	err, updated := initConfig(&c, name, configType, getConfigPath(), "plugin."+name, migrations, defaultFields...)
+	if e, ok := err.(*ConfigMigrationError); ok {
+		return c, e
+	}
+	if updated {
+		getLogger().Infof("Found config %s in an old version. Update to latest version.", name)
+	}
+	if err != nil {
+		getLogger().Warn(err)
+		getLogger().Infof("Config %s initialized unsuccessfully", name)
+	} else {
+		getLogger().Infof("Config %s initialized successfully", name)
+	}
+	return c, nil
+}
+
 func InitConfig(config *Configuration, name string, defaultFields ...map[string]interface{}) (Err error, updated bool) {
-	Err, updated = initConfig(config, name, ServerConfig.GetString("ConfigType"), ConfigPath, defaultFields...)
+	Err, updated = initConfig(config, name, ServerConfig.GetString("ConfigType"), getConfigPath(), "plugin."+name, nil, defaultFields...)
 	return Err, updated
 }
 
-func initConfig(config *Configuration, name string, configType string, configPath string, defaultFields ...map[string]interface{}) (Err error, updated bool) {
+// initConfig returns a *ConfigMigrationError directly if migrations failed
+func initConfig(config *Configuration, name string, configType string, configPath string, scope string, migrations []ConfigMigration, defaultFields ...map[string]interface{}) (Err error, updated bool) {
 
 	v := New()
 	conf := &oasisConfiguration{
-		Viper: v,
+		Viper:    v,
+		scope:    strings.ToLower(scope),
+		defaults: New(),
 	}
 	*config = conf
 
+	if err := checkConfigType(configType); err != nil {
+		getLogger().Warnf("%v. Use yml instead.", err)
+		configType = "yml"
+	}
 	v.SetConfigName(name)
 	v.AddConfigPath(configPath)
+	v.SetConfigFile(filepath.Join(configPath, name+"."+configType))
 	for _, m := range defaultFields {
 		for key, value := range m {
 			v.SetDefault(key, value)
+			conf.defaults.SetDefault(key, value)
 		}
 	}
 	v.SetConfigType(configType)
@@ -91,7 +430,7 @@ func initConfig(config *Configuration, name string, configType string, configPat
 	version := v.GetString("Version")
 
 	// Create default config file
-	CheckFolder(ConfigPath)
+	CheckFolder(configPath)
 	if err := v.SafeWriteConfig(); err != nil {
 		if _, ok := err.(ConfigFileAlreadyExistsError); !ok {
 			Err = fmt.Errorf("%v; %v", err, Err)
@@ -102,20 +441,34 @@ func initConfig(config *Configuration, name string, configType string, configPat
 	}
 
 	// Check config version and Update config if has field "Version"
-	if version != "" && v.GetString("Version") < version {
+	if version != "" && compareVersion(v.GetString("Version"), version) < 0 {
 		updated = true
-		v.Set("Version", version)
-		if err := v.WriteConfig(); err != nil {
-			Err = fmt.Errorf("%v; %v", err, Err)
+		if len(migrations) > 0 {
+			if err := migrateConfig(v, migrations, v.GetString("Version"), version); err != nil {
+				return err, false
+			}
+		} else {
+			v.Set("Version", version)
+			if err := v.WriteConfig(); err != nil {
+				Err = fmt.Errorf("%v; %v", err, Err)
+			}
 		}
 	}
-	v.WatchConfig()
-	v.OnConfigChange(func(e fsnotify.Event) {
+
+	conf.applyOverrides()
+	configsLock.Lock()
+	configs[conf.scope] = conf
+	configsLock.Unlock()
+
+	conf.watch(func(e fsnotify.Event) {
+		// Handles have been called by whom wrote it
+		if conf.isSelfWritten() {
+			return
+		}
+		getMetricsManager().configReloads.Inc(conf.scope)
 		if ServerConfig.GetBool("NotifyConfigChange") {
 			getLogger().Infof("Config file changed: %s", e.Name)
-			for _, v := range conf.handles {
-				v()
-			}
+			conf.runHandles()
 		}
 	})
 
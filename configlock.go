@@ -0,0 +1,282 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	. "github.com/xaxys/oasis/api"
+)
+
+// Viper isn't safe for concurrent use, so that its methods are
+// wrapped with viperLock of the config
+
+func (c *oasisConfiguration) AllSettings() map[string]interface{} {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.AllSettings()
+}
+
+func (c *oasisConfiguration) AllKeys() []string {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.AllKeys()
+}
+
+func (c *oasisConfiguration) IsSet(key string) bool {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.IsSet(key)
+}
+
+func (c *oasisConfiguration) InConfig(key string) bool {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.InConfig(key)
+}
+
+func (c *oasisConfiguration) Get(key string) interface{} {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.Get(key)
+}
+
+func (c *oasisConfiguration) GetString(key string) string {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetString(key)
+}
+
+func (c *oasisConfiguration) GetBool(key string) bool {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetBool(key)
+}
+
+func (c *oasisConfiguration) GetInt(key string) int {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetInt(key)
+}
+
+func (c *oasisConfiguration) GetInt32(key string) int32 {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetInt32(key)
+}
+
+func (c *oasisConfiguration) GetInt64(key string) int64 {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetInt64(key)
+}
+
+func (c *oasisConfiguration) GetUint(key string) uint {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetUint(key)
+}
+
+func (c *oasisConfiguration) GetUint32(key string) uint32 {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetUint32(key)
+}
+
+func (c *oasisConfiguration) GetUint64(key string) uint64 {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetUint64(key)
+}
+
+func (c *oasisConfiguration) GetFloat64(key string) float64 {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetFloat64(key)
+}
+
+func (c *oasisConfiguration) GetTime(key string) time.Time {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetTime(key)
+}
+
+func (c *oasisConfiguration) GetDuration(key string) time.Duration {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetDuration(key)
+}
+
+func (c *oasisConfiguration) GetIntSlice(key string) []int {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetIntSlice(key)
+}
+
+func (c *oasisConfiguration) GetStringSlice(key string) []string {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetStringSlice(key)
+}
+
+func (c *oasisConfiguration) GetStringMap(key string) map[string]interface{} {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetStringMap(key)
+}
+
+func (c *oasisConfiguration) GetStringMapString(key string) map[string]string {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetStringMapString(key)
+}
+
+func (c *oasisConfiguration) GetStringMapStringSlice(key string) map[string][]string {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetStringMapStringSlice(key)
+}
+
+func (c *oasisConfiguration) GetSizeInBytes(key string) uint {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.GetSizeInBytes(key)
+}
+
+func (c *oasisConfiguration) UnmarshalKey(key string, rawVal interface{}) error {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.UnmarshalKey(key, rawVal)
+}
+
+func (c *oasisConfiguration) Unmarshal(rawVal interface{}) error {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.Unmarshal(rawVal)
+}
+
+// SubConfig returns a copy of the sub tree, which isn't changed
+// when the config is reloaded
+func (c *oasisConfiguration) SubConfig(key string) Configuration {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return &oasisConfiguration{
+		Viper: c.Sub(key),
+	}
+}
+
+func (c *oasisConfiguration) RegisterAlias(alias string, key string) {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	c.Viper.RegisterAlias(alias, key)
+}
+
+func (c *oasisConfiguration) SetDefault(key string, value interface{}) {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	c.Viper.SetDefault(key, value)
+}
+
+func (c *oasisConfiguration) SetConfigType(in string) {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	c.Viper.SetConfigType(in)
+}
+
+func (c *oasisConfiguration) ReadInConfig() error {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	return c.Viper.ReadInConfig()
+}
+
+func (c *oasisConfiguration) MergeInConfig() error {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	return c.Viper.MergeInConfig()
+}
+
+func (c *oasisConfiguration) ReadConfig(in io.Reader) error {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	return c.Viper.ReadConfig(in)
+}
+
+func (c *oasisConfiguration) MergeConfig(in io.Reader) error {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	return c.Viper.MergeConfig(in)
+}
+
+func (c *oasisConfiguration) MergeConfigMap(cfg map[string]interface{}) error {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	return c.Viper.MergeConfigMap(cfg)
+}
+
+func (c *oasisConfiguration) SafeWriteConfig() error {
+	c.viperLock.RLock()
+	defer c.viperLock.RUnlock()
+	return c.Viper.SafeWriteConfig()
+}
+
+// setViper sets key in the override layer of Viper
+func (c *oasisConfiguration) setViper(key string, value interface{}) {
+	c.viperLock.Lock()
+	defer c.viperLock.Unlock()
+	c.Viper.Set(key, value)
+}
+
+// watch reads the config file again when it's changed, and calls
+// onChange after that. It replaces Viper.WatchConfig, which reads
+// the file without viperLock.
+func (c *oasisConfiguration) watch(onChange func(fsnotify.Event)) {
+	filename := c.ConfigFileUsed()
+	if filename == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		getLogger().Warnf("Failed to watch config %s. Details: %v", c.scope, err)
+		return
+	}
+	configFile := filepath.Clean(filename)
+	configDir, _ := filepath.Split(configFile)
+	realConfigFile, _ := filepath.EvalSymlinks(filename)
+	// The whole folder is watched to pick up renames and atomic saves
+	if err := watcher.Add(configDir); err != nil {
+		watcher.Close()
+		getLogger().Warnf("Failed to watch config %s. Details: %v", c.scope, err)
+		return
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// The file is written, or its real path is changed,
+				// e.g. a ConfigMap replaced in kubernetes
+				currentConfigFile, _ := filepath.EvalSymlinks(filename)
+				if (filepath.Clean(event.Name) == configFile && event.Op&(fsnotify.Write|fsnotify.Create) != 0) ||
+					(currentConfigFile != "" && currentConfigFile != realConfigFile) {
+					realConfigFile = currentConfigFile
+					if err := c.ReadInConfig(); err != nil {
+						getLogger().Warnf("Failed to read config %s. Details: %v", c.scope, err)
+					}
+					onChange(event)
+				} else if filepath.Clean(event.Name) == configFile && event.Op&fsnotify.Remove != 0 {
+					return
+				}
+			case err, ok := <-watcher.Errors:
+				if ok {
+					getLogger().Warnf("Error watching config %s. Details: %v", c.scope, err)
+				}
+				return
+			}
+		}
+	}()
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	. "github.com/xaxys/oasis/api"
 )
 
 const PrintBufferSize = 50
-const BytePoolSize = 512
+
+// Policies when the print buffer is full
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+)
 
 var formatterLock sync.Mutex
 var consolePrinter *oasisConsolePrinter
@@ -17,9 +26,19 @@ var consolePrinter *oasisConsolePrinter
 type oasisConsolePrinter struct {
 	wg            sync.WaitGroup
 	formatterList []Formatter
-	printBuffer   chan []byte
-	bytePool      sync.Pool
 	output        io.Writer
+	format        string
+	terminal      bool
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []*LogEntry
+	size    int
+	policy  string
+	stopped bool
+	done    bool   // printer goroutine exited
+	pending uint64 // dropped but not reported yet
+	dropped uint64
 }
 
 func getConsolePrinter() *oasisConsolePrinter {
@@ -35,44 +54,76 @@ func getConsolePrinter() *oasisConsolePrinter {
 
 func newConsolePrinter() *oasisConsolePrinter {
 	p := &oasisConsolePrinter{
-		bytePool: sync.Pool{
-			New: func() interface{} {
-				b := make([]byte, 0, BytePoolSize)
-				return &b
-			},
-		},
-		output: os.Stdout,
+		output:   os.Stdout,
+		format:   strings.ToLower(ServerConfig.GetString("ConsoleLogFormat")),
+		terminal: !headless && isTerminal(os.Stdout),
 	}
+	p.cond = sync.NewCond(&p.lock)
+	p.SetBuffer(ServerConfig.GetInt("ConsoleBufferSize"), ServerConfig.GetString("ConsoleOverflow"))
 	p.startPrinter()
 	return p
 }
 
+// isTerminal returns false if f is redirected, e.g. under systemd
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
 func (p *oasisConsolePrinter) startPrinter() {
-	p.printBuffer = make(chan []byte, PrintBufferSize)
+	p.wg.Add(1)
 	go func() {
-		p.wg.Add(1)
 		for {
-			b, ok := <-p.printBuffer
-			if !ok {
+			p.lock.Lock()
+			for len(p.queue) == 0 && !p.stopped {
+				p.cond.Wait()
+			}
+			if len(p.queue) == 0 {
+				p.done = true
+				p.lock.Unlock()
 				break
 			}
-			s := string(b)
-			b = b[0:0:BytePoolSize]
-			p.bytePool.Put(&b)
+			e := p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			pending := p.pending
+			p.pending = 0
+			p.cond.Broadcast()
+			p.lock.Unlock()
 
-			formatterLock.Lock()
-			for _, f := range p.formatterList {
-				s = f.Format(s)
+			if pending > 0 {
+				p.write(fmt.Sprintf("... %d lines dropped\n", pending))
 			}
-			formatterLock.Unlock()
-
-			s = "\r" + s + "> "
-			p.output.Write([]byte(s))
+			p.print(e)
 		}
 		p.wg.Done()
 	}()
 }
 
+// print formats a copy of e, so that formatters never change
+// the entry kept by the log hub
+func (p *oasisConsolePrinter) print(e *LogEntry) {
+	entry := copyLogEntry(e)
+	formatterLock.Lock()
+	for _, f := range p.formatterList {
+		f.Format(&entry)
+	}
+	format := p.format
+	formatterLock.Unlock()
+
+	p.write(renderConsoleEntry(&entry, format))
+}
+
+func (p *oasisConsolePrinter) write(s string) {
+	if p.terminal {
+		s = "\r" + s + "> "
+	}
+	p.output.Write([]byte(s))
+}
+
 func (p *oasisConsolePrinter) RegisterFormatter(f Formatter) {
 	formatterLock.Lock()
 	p.formatterList = append(p.formatterList, f)
@@ -85,14 +136,95 @@ func (p *oasisConsolePrinter) ClearFormatter() {
 	formatterLock.Unlock()
 }
 
-func (p *oasisConsolePrinter) Write(b []byte) (int, error) {
-	bc := *(p.bytePool.Get().(*[]byte))
-	bc = append(bc, b...)
-	p.printBuffer <- bc
-	return len(b), nil
+// SetFormat sets console log format: color, plain or json
+func (p *oasisConsolePrinter) SetFormat(format string) {
+	formatterLock.Lock()
+	p.format = strings.ToLower(format)
+	formatterLock.Unlock()
+}
+
+func (p *oasisConsolePrinter) GetFormat() string {
+	formatterLock.Lock()
+	defer formatterLock.Unlock()
+	return p.format
+}
+
+// SetBuffer sets buffer size and overflow policy: block, drop-oldest or drop-newest
+func (p *oasisConsolePrinter) SetBuffer(size int, policy string) {
+	if size <= 0 {
+		size = PrintBufferSize
+	}
+	policy = strings.ToLower(policy)
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		policy = OverflowDropOldest
+	}
+	p.lock.Lock()
+	p.size = size
+	p.policy = policy
+	if n := len(p.queue) - size; n > 0 && policy != OverflowBlock {
+		atomic.AddUint64(&p.dropped, uint64(n))
+		p.pending += uint64(n)
+		if policy == OverflowDropNewest {
+			p.queue = p.queue[:size:size]
+		} else {
+			p.queue = append([]*LogEntry(nil), p.queue[n:]...)
+		}
+	}
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
+
+// IsTerminal returns false if stdout isn't a terminal
+func (p *oasisConsolePrinter) IsTerminal() bool {
+	return p.terminal
+}
+
+// GetDropped returns how many lines are dropped for a full buffer
+func (p *oasisConsolePrinter) GetDropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Print never blocks unless the policy is block.
+// Entries are printed directly after the printer goroutine exited,
+// and queued regardless of buffer size while it is draining.
+func (p *oasisConsolePrinter) Print(e *LogEntry) {
+	p.lock.Lock()
+	for !p.stopped && len(p.queue) >= p.size && p.policy == OverflowBlock {
+		p.cond.Wait()
+	}
+	if p.done {
+		p.print(e)
+		p.lock.Unlock()
+		return
+	}
+	if p.stopped {
+		p.queue = append(p.queue, e)
+		p.cond.Broadcast()
+		p.lock.Unlock()
+		return
+	}
+	if len(p.queue) >= p.size {
+		atomic.AddUint64(&p.dropped, 1)
+		p.pending++
+		if p.policy == OverflowDropNewest {
+			p.lock.Unlock()
+			return
+		}
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+	}
+	p.queue = append(p.queue, e)
+	p.cond.Broadcast()
+	p.lock.Unlock()
 }
 
+// Stop prints entries left in buffer and returns
 func (p *oasisConsolePrinter) Stop() {
-	close(p.printBuffer)
+	p.lock.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.lock.Unlock()
 	p.wg.Wait()
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// maskFormatter hides the user field and adds a masked one
+type maskFormatter struct{}
+
+func (maskFormatter) Format(e *LogEntry) {
+	delete(e.Fields, "user")
+	e.Fields["masked"] = true
+	e.Message = strings.ToUpper(e.Message)
+}
+
+func TestPrintDoesNotChangeEntry(t *testing.T) {
+	var buf bytes.Buffer
+	p := &oasisConsolePrinter{
+		formatterList: []Formatter{maskFormatter{}},
+		output:        &buf,
+		format:        "plain",
+	}
+	e := &LogEntry{
+		Time:    time.Now(),
+		Level:   "INFO",
+		Message: "login",
+		Fields:  map[string]interface{}{"user": "xaxys"},
+	}
+	p.print(e)
+
+	if out := buf.String(); !strings.Contains(out, "LOGIN masked=true") || strings.Contains(out, "xaxys") {
+		t.Fatalf("Entry is printed as %q", out)
+	}
+	if e.Message != "login" || len(e.Fields) != 1 || e.Fields["user"] != "xaxys" {
+		t.Fatalf("Entry is changed by formatter: %q %v", e.Message, e.Fields)
+	}
+}
@@ -9,12 +9,23 @@ import (
 func startReader() {
 	go func() {
 		scanner := bufio.NewScanner(os.Stdin)
-		fmt.Print("> ")
-		fmt.Scanln()
+		prompt()
 		for scanner.Scan() {
 			line := scanner.Text()
 			GetServer().ExcuteCommand(consoleCaller, line)
-			fmt.Print("> ")
+			prompt()
+		}
+		// Stdin is closed or not provided, e.g. running as a daemon
+		if err := scanner.Err(); err != nil {
+			getLogger().Warnf("Console input is closed. Details: %v", err)
+		} else {
+			getLogger().Debug("Console input is closed")
 		}
 	}()
 }
+
+func prompt() {
+	if getConsolePrinter().IsTerminal() {
+		fmt.Print("> ")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultDatabaseDriver is used if DatabaseDriver of the plugin is not set
+const DefaultDatabaseDriver = "sqlite3"
+
+// DatabaseFileName is the sqlite database file in the plugin folder
+const DatabaseFileName = "database.db"
+
+var databasesLock sync.Mutex
+var databases = map[string]*sql.DB{}
+
+// getDatabase opens the database of the plugin once. DatabaseDriver and
+// DatabaseDSN of the plugin in PluginManagerConfig are used if set,
+// otherwise it's a sqlite database in the plugin folder.
+func getDatabase(name string) (*sql.DB, error) {
+	databasesLock.Lock()
+	defer databasesLock.Unlock()
+	if db, ok := databases[name]; ok {
+		return db, nil
+	}
+	driver := databaseDriver(name)
+	if !driverRegistered(driver) {
+		return nil, fmt.Errorf("Failed to open database of %s. Details: driver %s is not registered in the server", name, driver)
+	}
+	dsn := PluginManagerConfig.GetString(name + ".DatabaseDSN")
+	if dsn == "" {
+		if driver != DefaultDatabaseDriver {
+			return nil, fmt.Errorf("DatabaseDSN of %s is required by driver %s", name, driver)
+		}
+		folder := CheckFolder(ServerConfig.GetString("PluginResourcePath"), name)
+		dsn = "file:" + filepath.Join(folder, DatabaseFileName) + "?_busy_timeout=5000&_foreign_keys=1"
+	}
+	db, err := sql.Open(driver, dsn)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open database of %s. Details: %v", name, err)
+	}
+	if driver == DefaultDatabaseDriver {
+		// sqlite allows only one writer
+		db.SetMaxOpenConns(1)
+	}
+	databases[name] = db
+	return db, nil
+}
+
+// databaseDriver returns DatabaseDriver of the plugin, or sqlite3 if not set
+func databaseDriver(name string) string {
+	if driver := PluginManagerConfig.GetString(name + ".DatabaseDriver"); driver != "" {
+		return driver
+	}
+	return DefaultDatabaseDriver
+}
+
+// driverRegistered returns true if the driver is imported in the server
+func driverRegistered(driver string) bool {
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// closeDatabase closes the database of the plugin if it's opened
+func closeDatabase(name string) {
+	databasesLock.Lock()
+	db, ok := databases[name]
+	delete(databases, name)
+	databasesLock.Unlock()
+	if !ok {
+		return
+	}
+	if err := db.Close(); err != nil {
+		getLogger().Warnf("Failed to close database of %s. Details: %v", name, err)
+	} else {
+		getLogger().Debugf("Database of %s closed", name)
+	}
+}
+
+// closeDatabases closes all databases opened
+func closeDatabases() {
+	databasesLock.Lock()
+	var names []string
+	for name := range databases {
+		names = append(names, name)
+	}
+	databasesLock.Unlock()
+	for _, name := range names {
+		closeDatabase(name)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDatabaseDriverNotRegistered(t *testing.T) {
+	PluginManagerConfig.Set("nodriver.DatabaseDriver", "nosuchdriver")
+	PluginManagerConfig.Set("nodriver.DatabaseDSN", "whatever")
+	db, err := getDatabase("nodriver")
+	if err == nil {
+		db.Close()
+		t.Fatal("Database is opened with a driver not registered")
+	}
+	if !strings.Contains(err.Error(), "driver nosuchdriver is not registered") {
+		t.Fatalf("Got %v", err)
+	}
+}
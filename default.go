@@ -2,6 +2,10 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/xaxys/oasis/api"
 )
@@ -9,7 +13,7 @@ import (
 // Default Configs
 
 func initServerConfig() {
-	err, updated := initConfig(&ServerConfig, ServerConfigName, "yml", ".", serverConfigDefault)
+	err, updated := initConfig(&ServerConfig, ServerConfigName, serverConfigType, serverConfigDir, "server", nil, serverConfigDefault)
 	if updated {
 		getLogger().Infof("Found config %s in an old version. Update to latest version.", ServerConfigName)
 	}
@@ -19,8 +23,9 @@ func initServerConfig() {
 	} else {
 		getLogger().Infof("Config %s initialized successfully", ServerConfigName)
 	}
+	recordStartupValues()
 
-	err, updated = initConfig(&PluginManagerConfig, PluginManagerConfigName, "yml", ".", pluginManagerConfigDefault)
+	err, updated = initConfig(&PluginManagerConfig, PluginManagerConfigName, serverConfigType, serverConfigDir, "pluginmanager", nil, pluginManagerConfigDefault)
 	if updated {
 		getLogger().Infof("Found config %s in an old version. Update to latest version.", PluginManagerConfigName)
 	}
@@ -30,23 +35,69 @@ func initServerConfig() {
 	} else {
 		getLogger().Infof("Config %s initialized successfully", PluginManagerConfigName)
 	}
+
+	ServerConfig.AddHandle(func() {
+		if err := setServerLogLevel(ServerConfig.GetString("LogLevel")); err != nil {
+			getLogger().Warnf("Invalid LogLevel in %s. Details: %v", ServerConfigName, err)
+		}
+		getConsolePrinter().SetFormat(ServerConfig.GetString("ConsoleLogFormat"))
+		getConsolePrinter().SetBuffer(ServerConfig.GetInt("ConsoleBufferSize"), ServerConfig.GetString("ConsoleOverflow"))
+		applyLogFiles()
+		reloadLogWriters()
+	})
+	PluginManagerConfig.AddHandle(func() {
+		for _, p := range getPluginManager().GetAllPlugins() {
+			name := p.GetName()
+			if err := setPluginLogLevel(name, PluginManagerConfig.GetString(name+".LogLevel")); err != nil {
+				getLogger().Warnf("Invalid LogLevel of [%s] in %s. Details: %v", name, PluginManagerConfigName, err)
+			}
+		}
+	})
 }
 
-const ServerConfigName = "server"
+// OasisVersion is the version of server
+const OasisVersion = "0.1.4"
+
+// ServerConfigName can be changed by --config
+var ServerConfigName = "server"
+
 const PluginManagerConfigName = "plugin"
 
 var ServerConfig Configuration
 var PluginManagerConfig Configuration
 
 var serverConfigDefault = map[string]interface{}{
-	"Version":            "0.1.4",
+	"Version":            OasisVersion,
 	"LogLevel":           "info",
 	"LogPath":            "./logs/log.log",
+	"LogFormat":          "json",
+	"ConsoleLogFormat":   "color",
+	"PluginLogFiles":     false,
+	"LogBufferSize":      DefaultLogBufferSize,
+	"ConsoleBufferSize":  PrintBufferSize,
+	"ConsoleOverflow":    OverflowDropOldest,
+	"HTTPAddress":        "",
+	"HealthInterval":     "30s",
+	"HealthTimeout":      "5s",
+	"HookTimeout":        "30s",
+	"ShutdownTimeout":    "60s",
+	"PidFile":            "",
 	"PluginResourcePath": "./resources",
 	"PluginPath":         "./plugins",
+	"WatchPlugins":       false,
+	"WatchDebounce":      "2s",
+	"ConfigPath":         DefaultConfigPath,
 	"ConfigType":         "yml",
 	"DebugMode":          false,
 	"NotifyConfigChange": true,
+	"LogRotation": map[string]interface{}{
+		"MaxSize":    2,   // megabytes
+		"MaxBackups": 300, // 最多保留300个备份
+		"MaxAge":     365, // days
+		"Compress":   true,
+		"LocalTime":  false,
+		"Daily":      false,
+	},
 }
 
 var pluginManagerConfigDefault = map[string]interface{}{}
@@ -61,6 +112,15 @@ func initServerCommands() {
 	getCommandManager().RegisterCommand("pm", nil, pluginCommandExcutor)
 	getCommandManager().RegisterCommand("plugin", nil, pluginCommandExcutor)
 	getCommandManager().RegisterCommand("pluginmanager", nil, pluginCommandExcutor)
+
+	getCommandManager().RegisterCommand("config", nil, configCommandExcutor)
+	getCommandManager().RegisterCommand("cfg", nil, configCommandExcutor)
+
+	getCommandManager().RegisterCommand("log", nil, logCommandExcutor)
+
+	getCommandManager().RegisterCommand("reload", nil, reloadCommandExcutor)
+
+	getCommandManager().RegisterCommand("storage", nil, storageCommandExcutor)
 }
 
 var stopCommandExcutor StopCommandExcutor
@@ -71,30 +131,52 @@ func (StopCommandExcutor) OnCommand(p Plugin, command string, args []string) {
 	getServer().Stop()
 }
 
+var reloadCommandExcutor ReloadCommandExcutor
+
+type ReloadCommandExcutor struct{}
+
+func (ReloadCommandExcutor) OnCommand(p Plugin, command string, args []string) {
+	changes := reloadServer()
+	if len(changes) > 0 {
+		fmt.Println("Changes below require a restart:")
+		for _, v := range changes {
+			fmt.Println(">>> " + v)
+		}
+	}
+}
+
 var pluginCommandExcutor PluginCommandExcutor
 
 type PluginCommandExcutor struct{}
 
 func (PluginCommandExcutor) OnCommand(p Plugin, command string, args []string) {
 	if len(args) == 1 && (args[0] == "l" || args[0] == "list") {
-		plugin := GetServer().GetEnabledPlugins()
-		fmt.Printf("Found %d Enabled plugins:", len(plugin))
-		for i, v := range plugin {
-			if i%5 == 0 {
-				fmt.Println()
+		for _, state := range pluginStates {
+			plugin := getPluginManager().GetPluginsByState(state)
+			if len(plugin) == 0 {
+				continue
 			}
-			fmt.Printf("[%s] \t", v)
-		}
-		fmt.Println()
-		plugin = GetServer().GetDisabledPlugins()
-		fmt.Printf("Found %d Disabled plugins:", len(plugin))
-		for i, v := range plugin {
-			if i%5 == 0 {
-				fmt.Println()
+			fmt.Printf("Found %d %s plugins:", len(plugin), strings.Title(string(state)))
+			for i, v := range plugin {
+				if i%5 == 0 {
+					fmt.Println()
+				}
+				switch state {
+				case PluginEnabled:
+					h := v.GetHealth()
+					if h.Message != "" {
+						fmt.Printf("[%s] %s: %s \t", v, h.Status, h.Message)
+					} else {
+						fmt.Printf("[%s] %s \t", v, h.Status)
+					}
+				case PluginFailed:
+					fmt.Printf("[%s] %s \t", v, v.GetFailure())
+				default:
+					fmt.Printf("[%s] \t", v)
+				}
 			}
-			fmt.Printf("[%s] \t", v)
+			fmt.Println()
 		}
-		fmt.Println()
 		return
 	}
 	if len(args) > 1 && (args[0] == "i" || args[0] == "info") {
@@ -114,7 +196,8 @@ func (PluginCommandExcutor) OnCommand(p Plugin, command string, args []string) {
 			if plugin == nil {
 				fmt.Printf("No such a plugin Named: %s", v)
 			} else {
-				plugin.Enable()
+				getSupervisor().ResetRestarts(plugin)
+				enablePlugin(plugin, "enabled by console")
 			}
 		}
 		return
@@ -125,7 +208,7 @@ func (PluginCommandExcutor) OnCommand(p Plugin, command string, args []string) {
 			if plugin == nil {
 				fmt.Printf("No such a plugin Named: %s", v)
 			} else {
-				plugin.Disable()
+				disablePlugin(plugin, "disabled by console")
 			}
 		}
 		return
@@ -136,8 +219,8 @@ func (PluginCommandExcutor) OnCommand(p Plugin, command string, args []string) {
 			if plugin == nil {
 				fmt.Printf("No such a plugin Named: %s", v)
 			} else {
-				plugin.Disable()
-				plugin.Enable()
+				disablePlugin(plugin, "restarting by console")
+				enablePlugin(plugin, "restarted by console")
 			}
 		}
 		return
@@ -162,10 +245,289 @@ func (PluginCommandExcutor) OnCommand(p Plugin, command string, args []string) {
 		return
 	}
 
+	if len(args) > 1 && (args[0] == "p" || args[0] == "panics") {
+		for _, v := range args[1:] {
+			plugin := GetServer().GetPlugin(v)
+			if plugin == nil {
+				fmt.Printf("No such a plugin Named: %s", v)
+				continue
+			}
+			records := getSupervisor().GetPanics(plugin)
+			fmt.Printf("Found %d panics of [%s]:\n", len(records), plugin)
+			for _, r := range records {
+				fmt.Printf("[%s] in %s: %v\n%s\n", r.Time.Format(ConsoleTimeFormat), r.Source, r.Value, r.Stack)
+			}
+		}
+		return
+	}
+
+	if len(args) > 1 && (args[0] == "h" || args[0] == "history") {
+		for _, v := range args[1:] {
+			plugin := GetServer().GetPlugin(v)
+			if plugin == nil {
+				fmt.Printf("No such a plugin Named: %s", v)
+				continue
+			}
+			fmt.Printf("State history of [%s]:\n", plugin)
+			for _, t := range plugin.GetStateHistory() {
+				fmt.Printf("[%s] %s -> %s %s\n", t.Time.Format(ConsoleTimeFormat), t.From, t.To, t.Reason)
+			}
+		}
+		return
+	}
+
 	fmt.Println("------------[PluginManager Usage]------------")
 	fmt.Println(">>> l[ist] --------	| list plugins and statues")
 	fmt.Println(">>> i[nfo] <plugin>	| Show plugin info")
 	fmt.Println(">>> e[nable] <plugin>	| Enable plugin")
 	fmt.Println(">>> d[isable] <plugin>	| Disable plugin")
 	fmt.Println(">>> u[sage] <plugin>	| Check registed commands")
+	fmt.Println(">>> p[anics] <plugin>	| Show recovered panics")
+	fmt.Println(">>> h[istory] <plugin>	| Show state transitions")
+}
+
+var configCommandExcutor ConfigCommandExcutor
+
+type ConfigCommandExcutor struct{}
+
+func (ConfigCommandExcutor) OnCommand(p Plugin, command string, args []string) {
+	if len(args) > 0 && (args[0] == "s" || args[0] == "show") {
+		origin := false
+		var scopes []string
+		for _, v := range args[1:] {
+			if v == "--origin" || v == "-o" {
+				origin = true
+			} else {
+				scopes = append(scopes, v)
+			}
+		}
+		if len(scopes) == 0 {
+			scopes = getConfigScopes()
+		}
+		for _, v := range scopes {
+			c := findConfig(v)
+			if c == nil {
+				fmt.Printf("No such a config Named: %s\n", v)
+				continue
+			}
+			fmt.Printf("[%s]\n", c.scope)
+			keys := c.AllKeys()
+			sort.Strings(keys)
+			for _, key := range keys {
+				if origin {
+					fmt.Printf("\t%s = %v \t(%s)\n", key, c.Get(key), c.GetOrigin(key))
+				} else {
+					fmt.Printf("\t%s = %v\n", key, c.Get(key))
+				}
+			}
+		}
+		return
+	}
+	if len(args) > 1 && (args[0] == "l" || args[0] == "list") {
+		for _, v := range args[1:] {
+			c := findConfig(v)
+			if c == nil {
+				fmt.Printf("No such a config Named: %s\n", v)
+				continue
+			}
+			keys := c.AllKeys()
+			sort.Strings(keys)
+			fmt.Printf("Found %d keys in [%s]:\n", len(keys), c.scope)
+			for _, key := range keys {
+				fmt.Printf("\t%s = %v\n", key, c.Get(key))
+			}
+		}
+		return
+	}
+	if len(args) == 3 && (args[0] == "g" || args[0] == "get") {
+		c := findConfig(args[1])
+		if c == nil {
+			fmt.Printf("No such a config Named: %s\n", args[1])
+		} else if !c.IsSet(args[2]) {
+			fmt.Printf("No such a key Named: %s\n", args[2])
+		} else {
+			fmt.Printf("%s = %v\n", args[2], c.Get(args[2]))
+		}
+		return
+	}
+	if len(args) > 3 && args[0] == "set" {
+		c := findConfig(args[1])
+		if c == nil {
+			fmt.Printf("No such a config Named: %s\n", args[1])
+			return
+		}
+		key := args[2]
+		old := c.Get(key)
+		if old == nil {
+			old = c.GetDefault(key)
+		}
+		value, err := parseConfigValue(old, strings.Join(args[3:], " "))
+		if err != nil {
+			fmt.Printf("Invalid value for %s (%T). Details: %v\n", key, old, err)
+			return
+		}
+		// Written in file instead of Set, so that the file can still be edited
+		if err := c.setInFile(key, value); err != nil {
+			fmt.Printf("Failed to write config %s. Details: %v\n", c.scope, err)
+			return
+		}
+		getLogger().Infof("Config %s changed: %s = %v", c.scope, key, value)
+		if origin := c.GetOrigin(key); origin != OriginFile {
+			fmt.Printf("%s is still overridden by %s\n", key, origin)
+		}
+		c.runHandles()
+		return
+	}
+	if len(args) > 1 && (args[0] == "r" || args[0] == "reload") {
+		for _, v := range args[1:] {
+			c := findConfig(v)
+			if c == nil {
+				fmt.Printf("No such a config Named: %s\n", v)
+				continue
+			}
+			if err := c.reload(); err != nil {
+				fmt.Printf("Failed to reload config %s. Details: %v\n", c.scope, err)
+			}
+		}
+		return
+	}
+	if len(args) > 1 && (args[0] == "d" || args[0] == "diff") {
+		for _, v := range args[1:] {
+			c := findConfig(v)
+			if c == nil {
+				fmt.Printf("No such a config Named: %s\n", v)
+				continue
+			}
+			keys := c.AllKeys()
+			sort.Strings(keys)
+			fmt.Printf("Differences of [%s] from defaults:\n", c.scope)
+			for _, key := range keys {
+				def := c.GetDefault(key)
+				if def == nil {
+					fmt.Printf("\t+ %s = %v\n", key, c.Get(key))
+				} else if fmt.Sprint(def) != fmt.Sprint(c.Get(key)) {
+					fmt.Printf("\t~ %s: %v -> %v\n", key, def, c.Get(key))
+				}
+			}
+		}
+		return
+	}
+
+	fmt.Println("--------------[Config Usage]--------------")
+	fmt.Println(">>> s[how] [config] [--origin]	| Show effective configs")
+	fmt.Println(">>> l[ist] <config>	| List keys and values")
+	fmt.Println(">>> g[et] <config> <key>	| Get a value")
+	fmt.Println(">>> set <config> <key> <value>	| Set a value and write to file")
+	fmt.Println(">>> r[eload] <config>	| Reload config from file")
+	fmt.Println(">>> d[iff] <config>	| Show differences from defaults")
+	fmt.Println("  config: server, pluginmanager, <plugin>, plugin.<plugin>/<file>")
+}
+
+var logCommandExcutor LogCommandExcutor
+
+type LogCommandExcutor struct{}
+
+func (LogCommandExcutor) OnCommand(p Plugin, command string, args []string) {
+	if len(args) == 1 && (args[0] == "l" || args[0] == "level") {
+		for _, v := range getLogLevels() {
+			fmt.Println(v)
+		}
+		return
+	}
+	if len(args) == 3 && (args[0] == "l" || args[0] == "level") {
+		var err error
+		if args[1] == "server" {
+			err = setServerLogLevel(args[2])
+		} else if GetServer().GetPlugin(args[1]) == nil {
+			err = fmt.Errorf("No such a plugin Named: %s", args[1])
+		} else {
+			err = setPluginLogLevel(args[1], args[2])
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			getLogger().Infof("Log level of %s is set to %s", args[1], args[2])
+		}
+		return
+	}
+
+	if len(args) > 0 && (args[0] == "t" || args[0] == "tail") {
+		q, rest, err := parseLogQuery(args[1:])
+		q.Limit = 20
+		if err == nil && len(rest) == 1 {
+			q.Limit, err = strconv.Atoi(rest[0])
+		} else if err == nil && len(rest) > 1 {
+			err = fmt.Errorf("Too many arguments: %v", rest)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		printLogs(q)
+		return
+	}
+	if len(args) > 1 && (args[0] == "s" || args[0] == "search") {
+		q, rest, err := parseLogQuery(args[1:])
+		if err == nil && len(rest) == 0 {
+			err = fmt.Errorf("Pattern is required")
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		q.Pattern = strings.Join(rest, " ")
+		printLogs(q)
+		return
+	}
+
+	fmt.Println("---------------[Log Usage]---------------")
+	fmt.Println(">>> l[evel]	| Show log levels")
+	fmt.Println(">>> l[evel] <plugin|server> <level>	| Set log level: debug, info, warn, error, default")
+	fmt.Println(">>> t[ail] [n] [options]	| Show the last n log entries")
+	fmt.Println(">>> s[earch] <pattern> [options]	| Search log entries by regular expression")
+	fmt.Println("  options: --plugin <plugin> --level <level> --since <duration>")
+}
+
+// parseLogQuery parses options and returns other arguments
+func parseLogQuery(args []string) (LogQuery, []string, error) {
+	var q LogQuery
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--plugin", "--level", "--since":
+			if i+1 >= len(args) {
+				return q, nil, fmt.Errorf("Missing value of %s", args[i])
+			}
+			value := args[i+1]
+			switch args[i] {
+			case "--plugin":
+				q.Plugin = value
+			case "--level":
+				q.Level = value
+			case "--since":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return q, nil, fmt.Errorf("Invalid duration %s. Details: %v", value, err)
+				}
+				q.Since = time.Now().Add(-d)
+			}
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return q, rest, nil
+}
+
+func printLogs(q LogQuery) {
+	list, err := GetServer().QueryLogs(q)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	format := getConsolePrinter().GetFormat()
+	for i := range list {
+		fmt.Print(renderConsoleEntry(&list[i], format))
+	}
+	fmt.Printf("Found %d entries\n", len(list))
 }
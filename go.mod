@@ -5,8 +5,11 @@ go 1.14
 require (
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gookit/color v1.2.3
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/spf13/viper v1.6.2
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.14.0
+	golang.org/x/sys v0.10.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// healthTask checks health of enabled plugins
+type healthTask struct{}
+
+func (healthTask) Run() {
+	timeout := ServerConfig.GetDuration("HealthTimeout")
+	for _, p := range getPluginManager().GetEnabledPlugins() {
+		if op := toOasisPlugin(p); op != nil {
+			op.checkHealth(timeout)
+		}
+	}
+}
+
+func startHealthCheck() {
+	interval := ServerConfig.GetString("HealthInterval")
+	if _, ok := getTaskManager().RegisterTask(nil, "@every "+interval, healthTask{}); !ok {
+		getLogger().Warnf("Invalid HealthInterval %s, health check is disabled", interval)
+	}
+	getMetricsManager().HandleHTTP("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ok, report := checkHealthz()
+		writeHealthReport(w, ok, report)
+	})
+	getMetricsManager().HandleHTTP("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ok, report := checkReadyz()
+		writeHealthReport(w, ok, report)
+	})
+}
+
+func writeHealthReport(w http.ResponseWriter, ok bool, report []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, v := range report {
+		fmt.Fprintln(w, v)
+	}
+	if ok {
+		fmt.Fprintln(w, "ok")
+	} else {
+		fmt.Fprintln(w, "failed")
+	}
+}
+
+// isCritical reports whether the server is unhealthy if the plugin fails,
+// configured by Critical in plugin config
+func isCritical(p Plugin) bool {
+	return PluginManagerConfig.GetBool(p.GetName() + ".Critical")
+}
+
+// checkHealthz fails if any critical plugin is failing
+func checkHealthz() (bool, []string) {
+	ok := true
+	var report []string
+	for _, p := range getPluginManager().GetAllPlugins() {
+		h := p.GetHealth()
+		critical := isCritical(p)
+		if h.Status == HealthFailing && critical {
+			ok = false
+		}
+		report = append(report, formatHealth(p, h, critical))
+	}
+	return ok, report
+}
+
+// checkReadyz fails if plugins are still loading, or any critical
+// plugin isn't enabled or is failing
+func checkReadyz() (bool, []string) {
+	ok, report := checkHealthz()
+	if !getPluginManager().IsReady() {
+		ok = false
+		report = append(report, "plugins are loading")
+	}
+	for _, p := range getPluginManager().GetAllPlugins() {
+		if isCritical(p) && !p.IsEnabled() {
+			ok = false
+			report = append(report, fmt.Sprintf("[%s] is critical but not enabled", p))
+		}
+	}
+	return ok, report
+}
+
+func formatHealth(p Plugin, h Health, critical bool) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%s] %s", p, h.Status)
+	if critical {
+		sb.WriteString(" (critical)")
+	}
+	if h.Message != "" {
+		sb.WriteString(": ")
+		sb.WriteString(h.Message)
+	}
+	return sb.String()
+}
+
+func toOasisPlugin(p Plugin) *oasisPlugin {
+	switch t := p.(type) {
+	case *oasisPlugin:
+		return t
+	case *pluginInfo:
+		return toOasisPlugin(t.Plugin)
+	default:
+		return nil
+	}
+}
+
+// pluginKey returns the *oasisPlugin of p as map key,
+// so that p wrapped in *pluginInfo is the same plugin
+func pluginKey(p Plugin) Plugin {
+	if op := toOasisPlugin(p); op != nil {
+		return op
+	}
+	return p
+}
+
+// checkHealth calls CheckHealth of UserPlugin if it's a HealthChecker.
+// It's skipped if the previous call hasn't returned, e.g. timed out.
+func (p *oasisPlugin) checkHealth(timeout time.Duration) {
+	hc, ok := p.UserPlugin.(HealthChecker)
+	if !ok {
+		return
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	p.healthLock.Lock()
+	if p.healthChecking {
+		p.healthLock.Unlock()
+		return
+	}
+	p.healthChecking = true
+	p.healthLock.Unlock()
+
+	result := make(chan Health, 1)
+	go func() {
+		defer func() {
+			p.healthLock.Lock()
+			p.healthChecking = false
+			p.healthLock.Unlock()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				result <- Health{Status: HealthFailing, Message: fmt.Sprintf("health check panicked: %v", r)}
+			}
+		}()
+		result <- hc.CheckHealth()
+	}()
+	var h Health
+	select {
+	case h = <-result:
+	case <-time.After(timeout):
+		h = Health{Status: HealthFailing, Message: fmt.Sprintf("health check timed out after %v", timeout)}
+	}
+	if h.Status == "" {
+		h.Status = HealthOK
+	}
+
+	p.healthLock.Lock()
+	old := p.health
+	p.health = h
+	p.healthLock.Unlock()
+	if old.Status != h.Status {
+		if h.Status == HealthOK {
+			getLogger().Infof("Plugin [%s] is healthy now", p)
+		} else {
+			getLogger().Warnf("Plugin [%s] is %s: %s", p, h.Status, h.Message)
+		}
+	}
+}
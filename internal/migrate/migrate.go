@@ -0,0 +1,98 @@
+// Package migrate applies DatabaseMigration of plugins. It's shared by
+// the server and oasistest, and isn't a part of the plugin API.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+// Apply applies migrations not applied yet in order of version,
+// and returns the number of migrations applied. driver is the name
+// db is opened with, which decides the placeholder syntax.
+func Apply(db *sql.DB, driver string, migrations []api.DatabaseMigration) (int, error) {
+	list := append([]api.DatabaseMigration{}, migrations...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	for i := 1; i < len(list); i++ {
+		if list[i].Version == list[i-1].Version {
+			return 0, fmt.Errorf("Duplicate migration version %d", list[i].Version)
+		}
+	}
+
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + api.MigrationTable + " (version INTEGER PRIMARY KEY, description TEXT, applied_at BIGINT)")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create migration table. Details: %v", err)
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range list {
+		if applied[m.Version] {
+			continue
+		}
+		if err := applyMigration(db, driver, m); err != nil {
+			return count, fmt.Errorf("Failed to apply migration %d %s. Details: %v", m.Version, m.Description, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func appliedMigrations(db *sql.DB) (map[int]bool, error) {
+	rows, err := db.Query("SELECT version FROM " + api.MigrationTable)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read migration table. Details: %v", err)
+	}
+	defer rows.Close()
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs a migration and records it in a transaction
+func applyMigration(db *sql.DB, driver string, m api.DatabaseMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(m.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+	record := fmt.Sprintf("INSERT INTO %s (version, description, applied_at) VALUES (%s, %s, %s)",
+		api.MigrationTable, placeholder(driver, 1), placeholder(driver, 2), placeholder(driver, 3))
+	if _, err := tx.Exec(record, m.Version, m.Description, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// placeholder returns the nth bind parameter in the syntax of driver
+func placeholder(driver string, n int) string {
+	switch driver {
+	case "postgres", "pgx", "cloudsqlpostgres":
+		return fmt.Sprintf("$%d", n)
+	case "sqlserver", "mssql":
+		return fmt.Sprintf("@p%d", n)
+	case "oracle", "godror", "goracle", "oci8":
+		return fmt.Sprintf(":%d", n)
+	default:
+		return "?"
+	}
+}
@@ -0,0 +1,65 @@
+// Package version compares plugin and config versions. It's shared by
+// the server and oasistest, and isn't a part of the plugin API.
+package version
+
+import (
+	"strconv"
+	"strings"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+// Compare compares versions like "0.10.0" by numeric components,
+// and returns -1, 0 or 1. Components that aren't numbers are compared as
+// strings, and missing components are taken as 0.
+func Compare(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xerr != nil || yerr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Match reports whether version a satisfies opt against b,
+// e.g. Match("1.10", "1.9", api.GREATER) is true
+func Match(a string, b string, opt api.COMPARATOR) bool {
+	switch opt {
+	case api.GREATER:
+		return Compare(a, b) > 0
+	case api.GREATER_EQUAL:
+		return Compare(a, b) >= 0
+	case api.LESS:
+		return Compare(a, b) < 0
+	case api.LESS_EQUAL:
+		return Compare(a, b) <= 0
+	case api.EQUAL:
+		return Compare(a, b) == 0
+	case api.UNEQUAL:
+		return Compare(a, b) != 0
+	case api.ANY:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,48 @@
+package version
+
+import (
+	"testing"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.10", "1.9", 1},
+		{"1.9", "1.10", -1},
+		{"0.10.0", "0.9.9", 1},
+		{"v1.2", "1.2.0", 0},
+		{"1.0", "1", 0},
+		{"1.0-beta", "1.0-alpha", 1},
+	}
+	for _, c := range cases {
+		if got := Compare(c.a, c.b); got != c.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		a, b string
+		opt  api.COMPARATOR
+		want bool
+	}{
+		{"1.10", "1.9", api.GREATER, true},
+		{"1.10", "1.9", api.GREATER_EQUAL, true},
+		{"1.10", "1.9", api.LESS, false},
+		{"1.9", "1.10", api.LESS_EQUAL, true},
+		{"1.10", "1.10.0", api.EQUAL, true},
+		{"1.10", "1.9", api.UNEQUAL, true},
+		{"1.10", "1.9", api.ANY, true},
+		{"1.10", "1.9", api.COMPARATOR("~"), false},
+	}
+	for _, c := range cases {
+		if got := Match(c.a, c.b, c.opt); got != c.want {
+			t.Errorf("Match(%q, %q, %s) = %v, want %v", c.a, c.b, c.opt, got, c.want)
+		}
+	}
+}
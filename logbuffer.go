@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+const DefaultLogBufferSize = 1000
+
+var logHubLock sync.Mutex
+var logHub *oasisLogHub
+
+// oasisLogHub keeps recent entries in a ring buffer
+// and delivers new entries to subscribers
+type oasisLogHub struct {
+	lock        sync.Mutex
+	ring        []LogEntry
+	next        int
+	full        bool
+	subscribers map[*logSubscription]bool
+}
+
+type logSubscription struct {
+	hub     *oasisLogHub
+	match   func(*LogEntry) bool
+	ch      chan LogEntry
+	dropped uint64
+}
+
+func getLogHub() *oasisLogHub {
+	if logHub == nil {
+		logHubLock.Lock()
+		if logHub == nil {
+			logHub = newLogHub()
+		}
+		logHubLock.Unlock()
+	}
+	return logHub
+}
+
+func newLogHub() *oasisLogHub {
+	size := ServerConfig.GetInt("LogBufferSize")
+	if size <= 0 {
+		size = DefaultLogBufferSize
+	}
+	return &oasisLogHub{
+		ring:        make([]LogEntry, size),
+		subscribers: map[*logSubscription]bool{},
+	}
+}
+
+func (h *oasisLogHub) Publish(e LogEntry) {
+	e = copyLogEntry(&e)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ring[h.next] = e
+	h.next++
+	if h.next == len(h.ring) {
+		h.next = 0
+		h.full = true
+	}
+	for s := range h.subscribers {
+		if !s.match(&e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+func (h *oasisLogHub) Recent(n int) []LogEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var list []LogEntry
+	if h.full {
+		list = append(list, h.ring[h.next:]...)
+	}
+	list = append(list, h.ring[:h.next]...)
+	if n > 0 && len(list) > n {
+		list = list[len(list)-n:]
+	}
+	return list
+}
+
+func (h *oasisLogHub) Subscribe(q LogQuery, buffer int) (LogSubscription, error) {
+	q.Since = time.Time{}
+	match, err := newLogMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &logSubscription{
+		hub:   h,
+		match: match,
+		ch:    make(chan LogEntry, buffer),
+	}
+	h.lock.Lock()
+	h.subscribers[s] = true
+	h.lock.Unlock()
+	return s, nil
+}
+
+func (s *logSubscription) C() <-chan LogEntry {
+	return s.ch
+}
+
+func (s *logSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *logSubscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+	if s.hub.subscribers[s] {
+		delete(s.hub.subscribers, s)
+		close(s.ch)
+	}
+}
+
+func (oasisLogReader) RecentLogs(n int) []LogEntry {
+	return getLogHub().Recent(n)
+}
+
+func (oasisLogReader) SubscribeLogs(q LogQuery, buffer int) (LogSubscription, error) {
+	return getLogHub().Subscribe(q, buffer)
+}
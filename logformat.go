@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	. "github.com/xaxys/oasis/api"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+const ConsoleTimeFormat = "01-02 15:04:05"
+const LogfmtTimeFormat = "2006-01-02T15:04:05.000Z0700"
+
+// consoleCore sends structured entries to the console printer
+type consoleCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func newConsoleCore(level zapcore.LevelEnabler) zapcore.Core {
+	return &consoleCore{
+		LevelEnabler: level,
+	}
+}
+
+func (c *consoleCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &consoleCore{
+		LevelEnabler: c.LevelEnabler,
+		fields:       make([]zapcore.Field, 0, len(c.fields)+len(fields)),
+	}
+	clone.fields = append(clone.fields, c.fields...)
+	clone.fields = append(clone.fields, fields...)
+	return clone
+}
+
+func (c *consoleCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *consoleCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	e := newLogEntry(ent, c.fields, fields)
+	getMetricsManager().logLines.Inc(e.Level)
+	getLogHub().Publish(*e)
+	getConsolePrinter().Print(e)
+	return nil
+}
+
+func (c *consoleCore) Sync() error {
+	return nil
+}
+
+func newLogEntry(ent zapcore.Entry, fieldLists ...[]zapcore.Field) *LogEntry {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, fields := range fieldLists {
+		for _, f := range fields {
+			f.AddTo(enc)
+		}
+	}
+	e := &LogEntry{
+		Time:    ent.Time,
+		Level:   ent.Level.CapitalString(),
+		Message: ent.Message,
+		Fields:  enc.Fields,
+	}
+	if plugin, ok := enc.Fields["plugin"].(string); ok {
+		e.Plugin = plugin
+		delete(enc.Fields, "plugin")
+	}
+	if ent.Caller.Defined {
+		e.Caller = ent.Caller.String()
+	}
+	return e
+}
+
+// copyLogEntry returns a copy of e with its own Fields, since an entry
+// is shared by the console printer, log hub and subscribers
+func copyLogEntry(e *LogEntry) LogEntry {
+	c := *e
+	c.Fields = make(map[string]interface{}, len(e.Fields))
+	for k, v := range e.Fields {
+		c.Fields[k] = v
+	}
+	return c
+}
+
+// renderConsoleEntry renders entry in format "color", "plain" or "json"
+func renderConsoleEntry(e *LogEntry, format string) string {
+	if format == "json" {
+		m := map[string]interface{}{
+			"time":  e.Time.Format(LogfmtTimeFormat),
+			"level": e.Level,
+			"msg":   e.Message,
+		}
+		if e.Plugin != "" {
+			m["plugin"] = e.Plugin
+		}
+		if e.Caller != "" {
+			m["linenum"] = e.Caller
+		}
+		for k, v := range e.Fields {
+			m[k] = v
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return fmt.Sprintf("%s %s %s\n", e.Time.Format(ConsoleTimeFormat), e.Level, e.Message)
+		}
+		return string(b) + "\n"
+	}
+
+	paint := func(c color.Color, s string) string {
+		if format == "plain" {
+			return s
+		}
+		return c.Render(s)
+	}
+	var sb strings.Builder
+	sb.WriteString(paint(color.FgGray, e.Time.Format(ConsoleTimeFormat)))
+	sb.WriteString(" ")
+	sb.WriteString(paint(levelColor(e.Level), fmt.Sprintf("%-5s", e.Level)))
+	if e.Plugin != "" {
+		sb.WriteString(" ")
+		sb.WriteString(paint(color.FgMagenta, "["+e.Plugin+"]"))
+	}
+	sb.WriteString(" ")
+	sb.WriteString(e.Message)
+	for _, k := range sortedKeys(e.Fields) {
+		sb.WriteString(" ")
+		sb.WriteString(paint(color.FgCyan, k+"="))
+		sb.WriteString(logfmtValue(e.Fields[k]))
+	}
+	if e.Caller != "" {
+		sb.WriteString(" ")
+		sb.WriteString(paint(color.FgGray, e.Caller))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func levelColor(level string) color.Color {
+	switch level {
+	case "DEBUG":
+		return color.FgBlue
+	case "INFO":
+		return color.FgGreen
+	case "WARN":
+		return color.FgYellow
+	default:
+		return color.FgRed
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// logfmtValue quotes the value if necessary
+func logfmtValue(v interface{}) string {
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case time.Time:
+		s = t.Format(LogfmtTimeFormat)
+	case time.Duration:
+		s = t.String()
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(t)
+		if err != nil {
+			s = fmt.Sprint(t)
+		} else {
+			s = string(b)
+		}
+	default:
+		s = fmt.Sprint(t)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+var logfmtPool = buffer.NewPool()
+
+// logfmtEncoder encodes entries as key=value pairs
+type logfmtEncoder struct {
+	*zapcore.MapObjectEncoder
+	cfg zapcore.EncoderConfig
+}
+
+func newLogfmtEncoder(cfg zapcore.EncoderConfig) zapcore.Encoder {
+	return &logfmtEncoder{
+		MapObjectEncoder: zapcore.NewMapObjectEncoder(),
+		cfg:              cfg,
+	}
+}
+
+func (enc *logfmtEncoder) Clone() zapcore.Encoder {
+	clone := &logfmtEncoder{
+		MapObjectEncoder: zapcore.NewMapObjectEncoder(),
+		cfg:              enc.cfg,
+	}
+	for k, v := range enc.Fields {
+		clone.Fields[k] = v
+	}
+	return clone
+}
+
+func (enc *logfmtEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	final := enc.Clone().(*logfmtEncoder)
+	for _, f := range fields {
+		f.AddTo(final)
+	}
+
+	buf := logfmtPool.Get()
+	add := func(key string, value interface{}) {
+		if key == "" {
+			return
+		}
+		if buf.Len() > 0 {
+			buf.AppendByte(' ')
+		}
+		buf.AppendString(key)
+		buf.AppendByte('=')
+		buf.AppendString(logfmtValue(value))
+	}
+	add(enc.cfg.TimeKey, ent.Time)
+	add(enc.cfg.LevelKey, ent.Level.CapitalString())
+	if ent.LoggerName != "" {
+		add(enc.cfg.NameKey, ent.LoggerName)
+	}
+	if ent.Caller.Defined {
+		add(enc.cfg.CallerKey, ent.Caller.String())
+	}
+	add(enc.cfg.MessageKey, ent.Message)
+	for _, k := range sortedKeys(final.Fields) {
+		add(k, final.Fields[k])
+	}
+	if ent.Stack != "" {
+		add(enc.cfg.StacktraceKey, ent.Stack)
+	}
+	buf.AppendString(enc.cfg.LineEnding)
+	return buf, nil
+}
@@ -1,19 +1,38 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	. "github.com/xaxys/oasis/api"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var timeFormat string
 var loggerLock sync.Mutex
 var loggerCore zapcore.Core
+
+// Settings of log files, changed by applyLogFiles
+var fileLogLock sync.RWMutex
+var loggerEncoder zapcore.Encoder
+var logPath string
+var pluginLogFiles bool
+
 var serverLogger *zap.SugaredLogger
+var serverLevel = zap.NewAtomicLevel()
+
+var pluginLevelsLock sync.Mutex
+var pluginLevels = map[string]*pluginLevel{}
+
+// pluginLevel follows the server level if inherit is true
+type pluginLevel struct {
+	zap.AtomicLevel
+	inherit bool
+}
 
 func getLogger() Logger {
 	if loggerCore == nil {
@@ -41,19 +60,35 @@ func getLogger() Logger {
 	return serverLogger
 }
 
+// syncLogger flushes buffered log entries
+func syncLogger() {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	if loggerCore != nil {
+		loggerCore.Sync()
+	}
+}
+
 type oasisLogger struct {
 	*zap.SugaredLogger
 }
 
 func GetPluginLogger(name string) Logger {
+	getLogger()
+	level := getPluginLevel(name)
+	if err := setPluginLogLevel(name, PluginManagerConfig.GetString(name+".LogLevel")); err != nil {
+		getLogger().Warnf("Invalid LogLevel of [%s] in %s. Details: %v", name, PluginManagerConfigName, err)
+	}
+	core := zapcore.NewTee(newCore(level), &fileCore{LevelEnabler: level, plugin: name})
+
 	var pluginLogger *zap.SugaredLogger
 	field := zap.Fields(zap.String("plugin", name))
 	if ServerConfig.GetBool("DebugMode") {
 		caller := zap.AddCaller()
 		development := zap.Development()
-		pluginLogger = zap.New(loggerCore, caller, development, field).Sugar()
+		pluginLogger = zap.New(core, caller, development, field).Sugar()
 	} else {
-		pluginLogger = zap.New(loggerCore, field).Sugar()
+		pluginLogger = zap.New(core, field).Sugar()
 	}
 
 	return &oasisLogger{
@@ -65,15 +100,20 @@ func GetPluginLogger(name string) Logger {
 // loglevel 日志级别
 func newLoggerCore(logpath string, loglevel string) zapcore.Core {
 
-	hook := lumberjack.Logger{
-		Filename:   logpath, // 日志文件路径
-		MaxSize:    2,       // megabytes
-		MaxBackups: 300,     // 最多保留300个备份
-		MaxAge:     365,     // days
-		Compress:   true,    // 是否压缩 disabled by default
+	// 设置日志级别
+	level, err := parseLevel(loglevel)
+	if err != nil {
+		level = zap.InfoLevel
 	}
+	serverLevel.SetLevel(level)
 
-	jsonEncoderConfig := zapcore.EncoderConfig{
+	applyLogFiles()
+	return newCore(serverLevel)
+}
+
+// newFileEncoder returns encoder of log files: json or logfmt
+func newFileEncoder(format string) zapcore.Encoder {
+	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "time",
 		LevelKey:       "level",
 		NameKey:        "logger",
@@ -88,26 +128,167 @@ func newLoggerCore(logpath string, loglevel string) zapcore.Core {
 		EncodeName:     zapcore.FullNameEncoder,
 	}
 
-	// 设置日志级别
-	var level zapcore.Level
+	switch strings.ToLower(format) {
+	case "logfmt":
+		return newLogfmtEncoder(encoderConfig)
+	default:
+		return zapcore.NewJSONEncoder(encoderConfig)
+	}
+}
+
+// applyLogFiles applies LogFormat, LogPath and PluginLogFiles
+// in server config to all loggers
+func applyLogFiles() {
+	fileLogLock.Lock()
+	defer fileLogLock.Unlock()
+	loggerEncoder = newFileEncoder(ServerConfig.GetString("LogFormat"))
+	logPath = ServerConfig.GetString("LogPath")
+	pluginLogFiles = ServerConfig.GetBool("PluginLogFiles")
+}
+
+// newCore returns a core writing to both log file and console
+func newCore(level zapcore.LevelEnabler) zapcore.Core {
+	return zapcore.NewTee(
+		&fileCore{LevelEnabler: level}, // 打印到文件
+		newConsoleCore(level),          // 打印到控制台
+	)
+}
+
+// fileCore encodes entries with the current file encoder and writes them
+// to LogPath, or to <plugin>.log beside it if plugin is set and
+// PluginLogFiles is on. So log files can be changed without rebuilding loggers.
+type fileCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+	plugin string
+}
+
+func (c *fileCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &fileCore{
+		LevelEnabler: c.LevelEnabler,
+		fields:       make([]zapcore.Field, 0, len(c.fields)+len(fields)),
+		plugin:       c.plugin,
+	}
+	clone.fields = append(clone.fields, c.fields...)
+	clone.fields = append(clone.fields, fields...)
+	return clone
+}
+
+func (c *fileCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *fileCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	fileLogLock.RLock()
+	enc, path, enabled := loggerEncoder, logPath, c.plugin == "" || pluginLogFiles
+	fileLogLock.RUnlock()
+	if !enabled {
+		return nil
+	}
+	if c.plugin != "" {
+		path = filepath.Join(filepath.Dir(path), c.plugin+".log")
+	}
+
+	clone := enc.Clone()
+	for _, f := range c.fields {
+		f.AddTo(clone)
+	}
+	buf, err := clone.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	_, err = getLogWriter(path).Write(buf.Bytes())
+	buf.Free()
+	return err
+}
+
+func (c *fileCore) Sync() error {
+	return nil
+}
+
+func parseLevel(loglevel string) (zapcore.Level, error) {
 	switch strings.ToLower(loglevel) {
 	case "debug":
-		level = zap.DebugLevel
+		return zap.DebugLevel, nil
 	case "info":
-		level = zap.InfoLevel
+		return zap.InfoLevel, nil
 	case "warn":
-		level = zap.WarnLevel
+		return zap.WarnLevel, nil
 	case "error":
-		level = zap.ErrorLevel
+		return zap.ErrorLevel, nil
 	default:
-		level = zap.InfoLevel
+		return zap.InfoLevel, fmt.Errorf("unknown log level %q, should be one of debug, info, warn, error", loglevel)
 	}
+}
 
-	core := zapcore.NewCore(
-		zapcore.NewJSONEncoder(jsonEncoderConfig),                                                 // 编码器配置
-		zapcore.NewMultiWriteSyncer(zapcore.AddSync(&hook), zapcore.AddSync(getConsolePrinter())), // 打印到文件
-		level, // 日志级别
-	)
+func getPluginLevel(name string) *pluginLevel {
+	pluginLevelsLock.Lock()
+	defer pluginLevelsLock.Unlock()
+	l, ok := pluginLevels[name]
+	if !ok {
+		l = &pluginLevel{
+			AtomicLevel: zap.NewAtomicLevelAt(serverLevel.Level()),
+			inherit:     true,
+		}
+		pluginLevels[name] = l
+	}
+	return l
+}
+
+// setServerLogLevel also changes plugins following the server level
+func setServerLogLevel(loglevel string) error {
+	level, err := parseLevel(loglevel)
+	if err != nil {
+		return err
+	}
+	serverLevel.SetLevel(level)
+	pluginLevelsLock.Lock()
+	for _, l := range pluginLevels {
+		if l.inherit {
+			l.SetLevel(level)
+		}
+	}
+	pluginLevelsLock.Unlock()
+	return nil
+}
 
-	return core
+// setPluginLogLevel makes the plugin follow the server level
+// if loglevel is empty or "default"
+func setPluginLogLevel(name string, loglevel string) error {
+	l := getPluginLevel(name)
+	if loglevel == "" || strings.ToLower(loglevel) == "default" {
+		pluginLevelsLock.Lock()
+		l.inherit = true
+		l.SetLevel(serverLevel.Level())
+		pluginLevelsLock.Unlock()
+		return nil
+	}
+	level, err := parseLevel(loglevel)
+	if err != nil {
+		return err
+	}
+	pluginLevelsLock.Lock()
+	l.inherit = false
+	l.SetLevel(level)
+	pluginLevelsLock.Unlock()
+	return nil
+}
+
+// getLogLevels returns levels of server and plugins
+func getLogLevels() []string {
+	var list []string
+	pluginLevelsLock.Lock()
+	for name, l := range pluginLevels {
+		if l.inherit {
+			list = append(list, fmt.Sprintf("%s: %s (default)", name, l.Level()))
+		} else {
+			list = append(list, fmt.Sprintf("%s: %s", name, l.Level()))
+		}
+	}
+	pluginLevelsLock.Unlock()
+	sort.Strings(list)
+	return append([]string{fmt.Sprintf("[server]: %s", serverLevel.Level())}, list...)
 }
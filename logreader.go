@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+	"go.uber.org/zap/zapcore"
+)
+
+type oasisLogReader struct{}
+
+func (oasisLogReader) QueryLogs(q LogQuery) ([]LogEntry, error) {
+	match, err := newLogMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := getLogFiles(ServerConfig.GetString("LogPath"))
+	if err != nil {
+		return nil, err
+	}
+	// Read from the newest file, so that tail doesn't read all files
+	var result []LogEntry
+	for i := len(files) - 1; i >= 0; i-- {
+		if !q.Since.IsZero() && files[i].ModTime().Before(q.Since) {
+			break
+		}
+		list, err := readLogFile(files[i].path, match)
+		if err != nil {
+			getLogger().Warnf("Failed to read log file %s. Details: %v", files[i].path, err)
+			continue
+		}
+		result = append(list, result...)
+		if q.Limit > 0 && len(result) >= q.Limit {
+			break
+		}
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result, nil
+}
+
+// newLogMatcher returns a function reporting whether an entry matches q.
+// Limit is ignored.
+func newLogMatcher(q LogQuery) (func(*LogEntry) bool, error) {
+	level := zapcore.DebugLevel
+	if q.Level != "" {
+		l, err := parseLevel(q.Level)
+		if err != nil {
+			return nil, err
+		}
+		level = l
+	}
+	var pattern *regexp.Regexp
+	if q.Pattern != "" {
+		p, err := regexp.Compile(q.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q. Details: %v", q.Pattern, err)
+		}
+		pattern = p
+	}
+	return func(e *LogEntry) bool {
+		if q.Plugin != "" && !strings.EqualFold(e.Plugin, q.Plugin) {
+			return false
+		}
+		var l zapcore.Level
+		if err := l.UnmarshalText([]byte(strings.ToLower(e.Level))); err == nil && l < level {
+			return false
+		}
+		if !q.Since.IsZero() && e.Time.Before(q.Since) {
+			return false
+		}
+		if pattern != nil && !pattern.MatchString(e.Message) && !pattern.MatchString(renderConsoleEntry(e, "plain")) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+type logFile struct {
+	os.FileInfo
+	path string
+}
+
+// getLogFiles returns backups made by lumberjack and the current
+// log file, from the oldest to the newest
+func getLogFiles(logpath string) ([]logFile, error) {
+	dir := filepath.Dir(logpath)
+	base := filepath.Base(logpath)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []logFile
+	var current *logFile
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		if name == base {
+			current = &logFile{info, filepath.Join(dir, name)}
+		} else if strings.HasPrefix(name, prefix) && (strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+".gz")) {
+			files = append(files, logFile{info, filepath.Join(dir, name)})
+		}
+	}
+	// Timestamp in backup name is sortable
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	if current != nil {
+		files = append(files, *current)
+	}
+	return files, nil
+}
+
+func readLogFile(path string, match func(*LogEntry) bool) ([]LogEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var list []LogEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := parseLogLine(scanner.Text())
+		if e != nil && match(e) {
+			list = append(list, *e)
+		}
+	}
+	return list, scanner.Err()
+}
+
+// parseLogLine parses a line in json or logfmt, nil if failed
+func parseLogLine(line string) *LogEntry {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	var m map[string]interface{}
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			return nil
+		}
+	} else {
+		m = parseLogfmt(line)
+	}
+	if m == nil {
+		return nil
+	}
+
+	e := &LogEntry{
+		Fields: map[string]interface{}{},
+	}
+	for k, v := range m {
+		s, _ := v.(string)
+		switch k {
+		case "time":
+			t, err := time.Parse(LogfmtTimeFormat, s)
+			if err != nil {
+				return nil
+			}
+			e.Time = t
+		case "level":
+			e.Level = s
+		case "msg":
+			e.Message = s
+		case "plugin":
+			e.Plugin = s
+		case "linenum":
+			e.Caller = s
+		default:
+			e.Fields[k] = v
+		}
+	}
+	if e.Time.IsZero() || e.Level == "" {
+		return nil
+	}
+	return e
+}
+
+// parseLogfmt parses key=value pairs, values may be quoted
+func parseLogfmt(line string) map[string]interface{} {
+	m := map[string]interface{}{}
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil
+		}
+		key := line[:i]
+		line = line[i+1:]
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := 1
+			for ; end < len(line); end++ {
+				if line[end] == '\\' {
+					end++
+				} else if line[end] == '"' {
+					break
+				}
+			}
+			if end >= len(line) {
+				return nil
+			}
+			v, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil
+			}
+			value = v
+			line = line[end+1:]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		m[key] = value
+	}
+	return m
+}
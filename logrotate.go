@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const DayFormat = "2006-01-02"
+
+var logWritersLock sync.Mutex
+var logWriters = map[string]*rotatingWriter{}
+
+// rotatingWriter rotates log file by size, and also daily if enabled.
+// Its settings can be changed at runtime by reload.
+type rotatingWriter struct {
+	lock   sync.Mutex
+	logger *lumberjack.Logger
+	daily  bool
+	day    string
+}
+
+// getLogWriter returns the same writer for the same file
+func getLogWriter(filename string) *rotatingWriter {
+	logWritersLock.Lock()
+	defer logWritersLock.Unlock()
+	w, ok := logWriters[filename]
+	if !ok {
+		w = &rotatingWriter{}
+		if info, err := os.Stat(filename); err == nil {
+			w.day = info.ModTime().Format(DayFormat)
+		}
+		w.configure(filename)
+		logWriters[filename] = w
+	}
+	return w
+}
+
+// reloadLogWriters applies rotation settings in server config to all log files
+func reloadLogWriters() {
+	logWritersLock.Lock()
+	for filename, w := range logWriters {
+		w.lock.Lock()
+		w.configure(filename)
+		w.lock.Unlock()
+	}
+	logWritersLock.Unlock()
+}
+
+// configure applies rotation settings. A new lumberjack.Logger is created
+// only if they are changed, as its settings are read by its goroutine
+// without lock, and the goroutine can't be stopped once started.
+// The old one is closed.
+func (w *rotatingWriter) configure(filename string) {
+	logger := &lumberjack.Logger{
+		Filename:   filename,                                      // 日志文件路径
+		MaxSize:    ServerConfig.GetInt("LogRotation.MaxSize"),    // megabytes
+		MaxBackups: ServerConfig.GetInt("LogRotation.MaxBackups"), // 最多保留备份个数
+		MaxAge:     ServerConfig.GetInt("LogRotation.MaxAge"),     // days
+		Compress:   ServerConfig.GetBool("LogRotation.Compress"),  // 是否压缩
+		LocalTime:  ServerConfig.GetBool("LogRotation.LocalTime"), // 备份文件名使用本地时间
+	}
+	old := w.logger
+	if old == nil || !sameRotation(old, logger) {
+		if old != nil {
+			old.Close()
+		}
+		w.logger = logger
+	}
+
+	daily := ServerConfig.GetBool("LogRotation.Daily")
+	if old != nil && daily && !w.daily {
+		// the file was written regardless of days, rotate from tomorrow
+		w.day = time.Now().Format(DayFormat)
+	}
+	w.daily = daily
+}
+
+func sameRotation(a, b *lumberjack.Logger) bool {
+	return a.Filename == b.Filename &&
+		a.MaxSize == b.MaxSize &&
+		a.MaxBackups == b.MaxBackups &&
+		a.MaxAge == b.MaxAge &&
+		a.Compress == b.Compress &&
+		a.LocalTime == b.LocalTime
+}
+
+func (w *rotatingWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.daily {
+		today := time.Now().Format(DayFormat)
+		if w.day != "" && w.day != today {
+			if err := w.logger.Rotate(); err != nil {
+				return 0, err
+			}
+		}
+		w.day = today
+	}
+	return w.logger.Write(b)
+}
+
+func (w *rotatingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.logger.Close()
+}
@@ -1,8 +1,7 @@
 package main
 
+import "os"
+
 func main() {
-	startReader()
-	myserver := getServer()
-	myserver.LoadPlugins()
-	myserver.Wait()
+	os.Exit(runCLI(os.Args[1:]))
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// TestMain runs tests in a temporary directory, as configs, logs
+// and plugin folders are created in the working directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "oasis")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	headless = true
+	flagOverrides["server.loglevel"] = "warn"
+	initServerConfig()
+
+	code := m.Run()
+
+	getTaskManager().Stop()
+	closeDatabases()
+	closeStorages()
+	getConsolePrinter().Stop()
+	syncLogger()
+	os.Chdir(wd)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// racePlugin registers a command and a task when enabled
+type racePlugin struct {
+	PluginBase
+	excuted int64
+}
+
+func (p *racePlugin) OnEnable() bool {
+	p.GetServer().RegisterCommand(p.Name, p.GetPlugin(), p)
+	p.GetServer().RegisterTask(p.GetPlugin(), "@every 1h", p)
+	return true
+}
+
+func (p *racePlugin) OnDisable() bool {
+	p.GetServer().UnregisterCommand(p.Name)
+	return true
+}
+
+func (p *racePlugin) OnCommand(Plugin, string, []string) {
+	atomic.AddInt64(&p.excuted, 1)
+}
+
+func (p *racePlugin) Run() {}
+
+// startRacePlugin adds a built-in plugin and loads it as LoadPlugins does,
+// which writes plugin.yml and makes it reloaded in background
+func startRacePlugin(t *testing.T, name string) (*racePlugin, *pluginInfo) {
+	up := &racePlugin{PluginBase: PluginBase{PluginDescription: PluginDescription{Name: name, Version: "0.1.0"}}}
+	op, err := newPlugin(up, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := getPluginManager()
+	pinfo, err := pm.addPlugin(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.loadLock.Lock()
+	pm.loadPlugins([]*pluginInfo{pinfo})
+	pm.loadLock.Unlock()
+	if !pinfo.IsEnabled() {
+		t.Fatalf("Plugin [%s] is %s: %s", pinfo, pinfo.GetPluginState(), pinfo.GetFailure())
+	}
+	return up, pinfo
+}
+
+func TestCommandManagerRace(t *testing.T) {
+	up, p := startRacePlugin(t, "racecommand")
+	cm := getCommandManager()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			command := fmt.Sprintf("race%d", i)
+			for j := 0; j < 200; j++ {
+				if !cm.RegisterCommand(command, p, up) {
+					t.Errorf("Command %s is not registered", command)
+					return
+				}
+				if !cm.ExcuteCommand(consoleCaller, command+" arg") {
+					t.Errorf("Command %s is not excuted", command)
+					return
+				}
+				cm.GetPrediction("race", false)
+				cm.GetPluginCommands(p)
+				if !cm.UnregisterCommand(command) {
+					t.Errorf("Command %s is not unregistered", command)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&up.excuted); n != 8*200 {
+		t.Fatalf("Commands are excuted %d times, want %d", n, 8*200)
+	}
+}
+
+func TestPluginLifecycleRace(t *testing.T) {
+	up, p := startRacePlugin(t, "racelifecycle")
+	cm := getCommandManager()
+	pm := getPluginManager()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				enablePlugin(p, "enabled by test")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				disablePlugin(p, "disabled by test")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cm.ExcuteCommand(consoleCaller, up.Name)
+				pm.GetEnabledPlugins()
+				p.GetStateHistory()
+				p.GetHealth()
+			}
+		}()
+	}
+	// plugin.yml is read again as if it's changed
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c := PluginManagerConfig.(*oasisConfiguration)
+		for j := 0; j < 50; j++ {
+			if err := c.ReadInConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// The plugin is in a stable state, and its command
+	// is registered only if it's enabled
+	enabled := p.IsEnabled()
+	state := p.GetPluginState()
+	if state != PluginEnabled && state != PluginDisabled {
+		t.Fatalf("Plugin [%s] is %s after all calls returned", p, state)
+	}
+	if ok := cm.ExcuteCommand(consoleCaller, up.Name); ok != enabled {
+		t.Fatalf("Command excuted %v while plugin is %s", ok, state)
+	}
+	if !enablePlugin(p, "enabled by test") && !enabled {
+		t.Fatalf("Plugin [%s] can't be enabled: %s", p, p.GetFailure())
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+const MetricsNamespace = "oasis"
+
+// Types of metrics
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+	MetricSummary = "summary"
+)
+
+var metricNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+var metricsManagerLock sync.Mutex
+var metricsManager *oasisMetricsManager
+
+type oasisMetricsManager struct {
+	lock       sync.Mutex
+	families   map[string]*metricFamily
+	collectors []func()
+	httpServer *http.Server
+	mux        *http.ServeMux
+
+	// Server metrics
+	plugins        *metricFamily
+	commands       *metricFamily
+	commandErrors  *metricFamily
+	taskRuns       *metricFamily
+	taskDurations  *metricFamily
+	configReloads  *metricFamily
+	logLines       *metricFamily
+	consoleDropped *metricFamily
+	uptime         *metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	owner  Plugin
+	lock   sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+	count       uint64
+}
+
+func getMetricsManager() *oasisMetricsManager {
+	if metricsManager == nil {
+		metricsManagerLock.Lock()
+		if metricsManager == nil {
+			metricsManager = newMetricsManager()
+		}
+		metricsManagerLock.Unlock()
+	}
+	return metricsManager
+}
+
+func newMetricsManager() *oasisMetricsManager {
+	mm := &oasisMetricsManager{
+		families: map[string]*metricFamily{},
+		mux:      http.NewServeMux(),
+	}
+	mm.plugins = mm.register(nil, "plugins", "Number of plugins by state.", MetricGauge, "state")
+	mm.commands = mm.register(nil, "commands_total", "Commands executed.", MetricCounter, "command", "caller")
+	mm.commandErrors = mm.register(nil, "command_errors_total", "Commands not found or panicked.", MetricCounter, "command", "error")
+	mm.taskRuns = mm.register(nil, "task_runs_total", "Tasks run.", MetricCounter, "plugin")
+	mm.taskDurations = mm.register(nil, "task_duration_seconds", "Duration of tasks.", MetricSummary, "plugin")
+	mm.configReloads = mm.register(nil, "config_reloads_total", "Configs reloaded.", MetricCounter, "config")
+	mm.logLines = mm.register(nil, "log_lines_total", "Log lines by level.", MetricCounter, "level")
+	mm.consoleDropped = mm.register(nil, "console_dropped_lines_total", "Lines dropped for a full console buffer.", MetricCounter)
+	mm.uptime = mm.register(nil, "uptime_seconds", "Running time of the server.", MetricGauge)
+
+	mm.AddCollector(func() {
+		mm.plugins.reset()
+		for _, p := range getPluginManager().GetAllPlugins() {
+			mm.plugins.Add(1, string(p.GetPluginState()))
+		}
+		mm.consoleDropped.reset()
+		mm.consoleDropped.Add(float64(getConsolePrinter().GetDropped()))
+		mm.uptime.Set(getServer().RunningTime().Seconds())
+	})
+	mm.mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mm.WriteMetrics(w)
+	})
+	return mm
+}
+
+func (mm *oasisMetricsManager) register(p Plugin, name string, help string, kind string, labels ...string) *metricFamily {
+	if p != nil {
+		name = "plugin_" + p.GetName() + "_" + name
+	}
+	name = MetricsNamespace + "_" + metricNameRegexp.ReplaceAllString(name, "_")
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	if f, ok := mm.families[name]; ok {
+		if f.kind != kind {
+			getLogger().Warnf("Metric %s has been registered as a %s", name, f.kind)
+			// Return an unregistered one to avoid nil
+			return newMetricFamily(name, help, kind, labels, p)
+		}
+		return f
+	}
+	f := newMetricFamily(name, help, kind, labels, p)
+	mm.families[name] = f
+	return f
+}
+
+func newMetricFamily(name string, help string, kind string, labels []string, p Plugin) *metricFamily {
+	return &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		owner:  pluginKey(p),
+		values: map[string]*metricValue{},
+	}
+}
+
+func (mm *oasisMetricsManager) NewCounter(p Plugin, name string, help string, labels ...string) Counter {
+	return mm.register(p, name, help, MetricCounter, labels...)
+}
+
+func (mm *oasisMetricsManager) NewGauge(p Plugin, name string, help string, labels ...string) Gauge {
+	return mm.register(p, name, help, MetricGauge, labels...)
+}
+
+func (mm *oasisMetricsManager) NewSummary(p Plugin, name string, help string, labels ...string) Summary {
+	return mm.register(p, name, help, MetricSummary, labels...)
+}
+
+// UnregisterPluginMetrics removes metrics registered by p, it's called
+// when p is disabled or failed
+func (mm *oasisMetricsManager) UnregisterPluginMetrics(p Plugin) {
+	if p == nil {
+		return
+	}
+	p = pluginKey(p)
+	mm.lock.Lock()
+	for name, f := range mm.families {
+		if f.owner == p {
+			delete(mm.families, name)
+		}
+	}
+	mm.lock.Unlock()
+}
+
+// AddCollector adds a function called before metrics are written
+func (mm *oasisMetricsManager) AddCollector(f func()) {
+	mm.lock.Lock()
+	mm.collectors = append(mm.collectors, f)
+	mm.lock.Unlock()
+}
+
+// WriteMetrics writes all metrics in Prometheus text format
+func (mm *oasisMetricsManager) WriteMetrics(w io.Writer) {
+	mm.lock.Lock()
+	collectors := append([]func(){}, mm.collectors...)
+	var families []*metricFamily
+	for _, f := range mm.families {
+		families = append(families, f)
+	}
+	mm.lock.Unlock()
+
+	for _, f := range collectors {
+		f()
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// HandleHTTP registers a handler served on HTTPAddress
+func (mm *oasisMetricsManager) HandleHTTP(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mm.mux.HandleFunc(pattern, handler)
+}
+
+// StartHTTP serves /metrics on HTTPAddress, it does nothing if HTTPAddress is empty
+func (mm *oasisMetricsManager) StartHTTP() {
+	addr := ServerConfig.GetString("HTTPAddress")
+	if addr == "" {
+		return
+	}
+	mm.lock.Lock()
+	mm.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: mm.mux,
+	}
+	server := mm.httpServer
+	mm.lock.Unlock()
+	go func() {
+		getLogger().Infof("Serving metrics on http://%s/metrics", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			getLogger().Errorf("Failed to serve on %s. Details: %v", addr, err)
+		}
+	}()
+}
+
+func (mm *oasisMetricsManager) Stop() {
+	mm.lock.Lock()
+	server := mm.httpServer
+	mm.httpServer = nil
+	mm.lock.Unlock()
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
+
+func (f *metricFamily) get(labelValues []string) *metricValue {
+	if len(labelValues) != len(f.labels) {
+		getLogger().Debugf("Metric %s needs %d label values, but got %d", f.name, len(f.labels), len(labelValues))
+		return nil
+	}
+	key := strings.Join(labelValues, "\xff")
+	v, ok := f.values[key]
+	if !ok {
+		v = &metricValue{
+			labelValues: append([]string{}, labelValues...),
+		}
+		f.values[key] = v
+	}
+	return v
+}
+
+func (f *metricFamily) reset() {
+	f.lock.Lock()
+	f.values = map[string]*metricValue{}
+	f.lock.Unlock()
+}
+
+func (f *metricFamily) Inc(labelValues ...string) {
+	f.Add(1, labelValues...)
+}
+
+func (f *metricFamily) Add(v float64, labelValues ...string) {
+	f.lock.Lock()
+	if m := f.get(labelValues); m != nil {
+		m.value += v
+	}
+	f.lock.Unlock()
+}
+
+func (f *metricFamily) Set(v float64, labelValues ...string) {
+	f.lock.Lock()
+	if m := f.get(labelValues); m != nil {
+		m.value = v
+	}
+	f.lock.Unlock()
+}
+
+func (f *metricFamily) Observe(v float64, labelValues ...string) {
+	f.lock.Lock()
+	if m := f.get(labelValues); m != nil {
+		m.value += v
+		m.count++
+	}
+	f.lock.Unlock()
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	var keys []string
+	for k := range f.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := f.values[k]
+		labels := f.formatLabels(v.labelValues)
+		if f.kind == MetricSummary {
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatMetricValue(v.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, v.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatMetricValue(v.value))
+		}
+	}
+}
+
+func (f *metricFamily) formatLabels(values []string) string {
+	if len(f.labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, escaper.Replace(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
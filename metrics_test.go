@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// metricPlugin counts in a metric registered when enabled
+type metricPlugin struct {
+	PluginBase
+}
+
+func (p *metricPlugin) OnEnable() bool {
+	p.GetServer().NewCounter(p.GetPlugin(), "greetings", "Greetings sent.", "name").Inc("world")
+	return true
+}
+
+func writtenMetrics() string {
+	var buf bytes.Buffer
+	getMetricsManager().WriteMetrics(&buf)
+	return buf.String()
+}
+
+func TestUnregisterPluginMetrics(t *testing.T) {
+	up := &metricPlugin{PluginBase: PluginBase{PluginDescription: PluginDescription{Name: "metricplugin", Version: "0.1.0"}}}
+	op, err := newPlugin(up, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := getPluginManager()
+	p, err := pm.addPlugin(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.loadLock.Lock()
+	pm.loadPlugins([]*pluginInfo{p})
+	pm.loadLock.Unlock()
+	if !p.IsEnabled() {
+		t.Fatalf("Plugin [%s] is %s: %s", p, p.GetPluginState(), p.GetFailure())
+	}
+
+	series := `oasis_plugin_metricplugin_greetings{name="world"} 1`
+	if metrics := writtenMetrics(); !strings.Contains(metrics, series) {
+		t.Fatalf("Metric of plugin isn't written:\n%s", metrics)
+	}
+	// Registered with the *pluginInfo wrapping the plugin
+	getMetricsManager().NewGauge(p, "mood", "Mood of plugin.").Set(1)
+	if !disablePlugin(p, "disabled by test") {
+		t.Fatalf("Plugin [%s] can't be disabled", p)
+	}
+	if metrics := writtenMetrics(); strings.Contains(metrics, "oasis_plugin_metricplugin_") {
+		t.Fatalf("Metrics of plugin are written after disabled:\n%s", metrics)
+	}
+
+	// Series start over when enabled again
+	if !enablePlugin(p, "enabled by test") {
+		t.Fatalf("Plugin [%s] can't be enabled: %s", p, p.GetFailure())
+	}
+	if metrics := writtenMetrics(); !strings.Contains(metrics, series) {
+		t.Fatalf("Metric of plugin isn't written after enabled again:\n%s", metrics)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	. "github.com/spf13/viper"
+	. "github.com/xaxys/oasis/api"
+)
+
+// ConfigMigrationError means a config file can't be migrated to the latest
+// version. The config file is kept as it was before migrating.
+type ConfigMigrationError struct {
+	File string
+	From string
+	To   string
+	Err  error
+}
+
+func (e *ConfigMigrationError) Error() string {
+	return fmt.Sprintf("Failed to migrate config %s from version %s to %s. Details: %v", e.File, e.From, e.To, e.Err)
+}
+
+// migrateConfig migrates the config file read by v from version from
+// to version to. A backup of the original file is written before migrating.
+func migrateConfig(v *Viper, migrations []ConfigMigration, from string, to string) error {
+	file := v.ConfigFileUsed()
+	fail := func(err error) error {
+		return &ConfigMigrationError{File: file, From: from, To: to, Err: err}
+	}
+
+	chain, err := migrationChain(migrations, from, to)
+	if err != nil {
+		return fail(err)
+	}
+
+	raw := New()
+	raw.SetConfigFile(file)
+	if err := raw.ReadInConfig(); err != nil {
+		return fail(err)
+	}
+	tree := ConfigTree(raw.AllSettings())
+
+	origin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fail(err)
+	}
+	backup := fmt.Sprintf("%s.%s.bak", file, from)
+	if err := ioutil.WriteFile(backup, origin, 0644); err != nil {
+		return fail(fmt.Errorf("failed to write backup %s: %v", backup, err))
+	}
+	getLogger().Infof("Config %s backed up to %s", file, backup)
+
+	for _, m := range chain {
+		getLogger().Infof("Migrating config %s from version %s to %s", file, m.From, m.To)
+		if err := runMigration(m, tree); err != nil {
+			return fail(fmt.Errorf("migration %s -> %s: %v", m.From, m.To, err))
+		}
+	}
+	tree.Set("Version", to)
+
+	out := New()
+	if err := out.MergeConfigMap(tree); err != nil {
+		return fail(err)
+	}
+	if err := out.WriteConfigAs(file); err != nil {
+		// Roll back
+		if err := ioutil.WriteFile(file, origin, 0644); err != nil {
+			getLogger().Errorf("Failed to restore config %s from %s. Details: %v", file, backup, err)
+		}
+		return fail(err)
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// migrationChain returns migrations between version from and to in order.
+// The chain must start from version from and end with version to, and
+// each migration must start from the version the previous one ends with.
+func migrationChain(migrations []ConfigMigration, from string, to string) ([]ConfigMigration, error) {
+	var chain []ConfigMigration
+	for _, m := range migrations {
+		if m.Migrate != nil && compareVersion(m.From, from) >= 0 && compareVersion(m.To, to) <= 0 {
+			chain = append(chain, m)
+		}
+	}
+	sort.SliceStable(chain, func(i, j int) bool {
+		return compareVersion(chain[i].From, chain[j].From) < 0
+	})
+	for i, m := range chain {
+		if compareVersion(m.From, m.To) >= 0 {
+			return nil, fmt.Errorf("migration %s -> %s doesn't upgrade the version", m.From, m.To)
+		}
+		if i > 0 && compareVersion(chain[i-1].To, m.From) != 0 {
+			return nil, fmt.Errorf("migrations are not contiguous: %s -> %s is followed by %s -> %s", chain[i-1].From, chain[i-1].To, m.From, m.To)
+		}
+	}
+	if compareVersion(from, to) == 0 {
+		return chain, nil
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no migration from %s to %s", from, to)
+	}
+	if first := chain[0]; compareVersion(first.From, from) != 0 {
+		return nil, fmt.Errorf("no migration from %s, the first one is %s -> %s", from, first.From, first.To)
+	}
+	if last := chain[len(chain)-1]; compareVersion(last.To, to) != 0 {
+		return nil, fmt.Errorf("no migration to %s, the last one is %s -> %s", to, last.From, last.To)
+	}
+	return chain, nil
+}
+
+func runMigration(m ConfigMigration, tree ConfigTree) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return m.Migrate(tree)
+}
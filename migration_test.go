@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/spf13/viper"
+	. "github.com/xaxys/oasis/api"
+)
+
+func noopMigration(from, to string) ConfigMigration {
+	return ConfigMigration{From: from, To: to, Migrate: func(ConfigTree) error { return nil }}
+}
+
+func TestMigrationChain(t *testing.T) {
+	migrations := []ConfigMigration{
+		noopMigration("1.10", "2.0"),
+		noopMigration("1.0", "1.9"),
+		noopMigration("1.9", "1.10"),
+	}
+	chain, err := migrationChain(migrations, "1.0", "2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range chain {
+		got = append(got, m.From+"->"+m.To)
+	}
+	if len(got) != 3 || got[0] != "1.0->1.9" || got[1] != "1.9->1.10" || got[2] != "1.10->2.0" {
+		t.Fatalf("Chain is %v", got)
+	}
+
+	if chain, err := migrationChain(migrations, "2.0", "2.0"); err != nil || len(chain) != 0 {
+		t.Fatalf("Chain to the same version is %v, %v", chain, err)
+	}
+}
+
+func TestMigrationChainGaps(t *testing.T) {
+	single := []ConfigMigration{noopMigration("1.0", "1.1")}
+	cases := []struct {
+		name       string
+		migrations []ConfigMigration
+		from, to   string
+	}{
+		{"gaps at both ends", single, "0.5", "2.0"},
+		{"gap at start", single, "0.5", "1.1"},
+		{"gap at end", single, "1.0", "2.0"},
+		{"empty chain", nil, "1.0", "2.0"},
+		{"gap in middle", []ConfigMigration{noopMigration("1.0", "1.1"), noopMigration("1.2", "2.0")}, "1.0", "2.0"},
+		{"downgrade", []ConfigMigration{noopMigration("1.0", "1.0")}, "1.0", "2.0"},
+	}
+	for _, c := range cases {
+		if chain, err := migrationChain(c.migrations, c.from, c.to); err == nil {
+			t.Errorf("%s: %s -> %s returned %d migrations without error", c.name, c.from, c.to, len(chain))
+		}
+	}
+}
+
+func TestMigrateConfigGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oasis-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "whatever.yml")
+	origin := []byte("version: \"0.5\"\nname: foo\n")
+	if err := ioutil.WriteFile(file, origin, 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateConfig(v, []ConfigMigration{noopMigration("1.0", "1.1")}, "0.5", "2.0")
+	if _, ok := err.(*ConfigMigrationError); !ok {
+		t.Fatalf("Got %v, want a *ConfigMigrationError", err)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != string(origin) {
+		t.Fatalf("Config file is changed to %q", b)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to systemd by the sd_notify protocol,
+// e.g. "READY=1". It does nothing if NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func notifyState(state string) {
+	if err := sdNotify(state); err != nil {
+		getLogger().Warnf("Failed to notify systemd %q. Details: %v", state, err)
+	}
+}
+
+// watchdogInterval returns half of WATCHDOG_USEC,
+// or 0 if the watchdog isn't enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startWatchdog sends WATCHDOG=1 periodically until stop is closed.
+// It doesn't use TaskManager, which is stopped before plugins in shutdown.
+func startWatchdog(stop <-chan struct{}) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	getLogger().Debugf("Notifying systemd watchdog every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				notifyState("WATCHDOG=1")
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
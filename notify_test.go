@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify listens on a unixgram socket and sets NOTIFY_SOCKET to it
+func listenNotify(t *testing.T, name, env string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, ok := os.LookupEnv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", env)
+	t.Cleanup(func() {
+		conn.Close()
+		if ok {
+			os.Setenv("NOTIFY_SOCKET", old)
+		} else {
+			os.Unsetenv("NOTIFY_SOCKET")
+		}
+	})
+	return conn
+}
+
+func expectNotify(t *testing.T, conn *net.UnixConn, state string) {
+	t.Helper()
+	notifyState(state)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 256)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("%q is not received. Details: %v", state, err)
+	}
+	if got := string(b[:n]); got != state {
+		t.Fatalf("received %q, want %q", got, state)
+	}
+}
+
+func TestNotifyState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oasis-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn := listenNotify(t, socket, socket)
+
+	expectNotify(t, conn, "READY=1\nSTATUS=Running")
+	expectNotify(t, conn, "STOPPING=1")
+	expectNotify(t, conn, "WATCHDOG=1")
+}
+
+func TestNotifyStateAbstract(t *testing.T) {
+	name := "oasis-notify-" + strconv.Itoa(os.Getpid())
+	conn := listenNotify(t, "\x00"+name, "@"+name)
+
+	expectNotify(t, conn, "READY=1")
+	expectNotify(t, conn, "STOPPING=1")
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	old, ok := os.LookupEnv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if ok {
+		defer os.Setenv("NOTIFY_SOCKET", old)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d := watchdogInterval(); d != time.Second {
+		t.Fatalf("got %v, want 1s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := watchdogInterval(); d != 0 {
+		t.Fatalf("got %v for another pid, want 0", d)
+	}
+	os.Unsetenv("WATCHDOG_USEC")
+	if d := watchdogInterval(); d != 0 {
+		t.Fatalf("got %v without WATCHDOG_USEC, want 0", d)
+	}
+}
@@ -0,0 +1,143 @@
+package oasistest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	api "github.com/xaxys/oasis/api"
+)
+
+// Clock is a fake clock moved only by Set or Server.Advance
+type Clock struct {
+	lock sync.RWMutex
+	now  time.Time
+}
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.now
+}
+
+// Set sets the time without running tasks
+func (c *Clock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// specParser parses specs the same as the server, with seconds
+var specParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+type task struct {
+	id       int
+	plugin   api.Plugin
+	schedule cron.Schedule
+	next     time.Time
+	api.Runnable
+}
+
+// taskManager runs tasks when the clock is advanced
+type taskManager struct {
+	server *Server
+	lock   sync.Mutex
+	nextID int
+	tasks  map[int]*task
+}
+
+func newTaskManager(s *Server) *taskManager {
+	return &taskManager{
+		server: s,
+		tasks:  map[int]*task{},
+	}
+}
+
+func (tm *taskManager) register(p api.Plugin, spec string, r api.Runnable) (int, bool) {
+	schedule, err := specParser.Parse(spec)
+	if err != nil {
+		tm.server.logs.log("", "warn", fmt.Sprintf("Failed to register task for %s. Details: %v", p, err), nil)
+		return 0, false
+	}
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.nextID++
+	tm.tasks[tm.nextID] = &task{
+		id:       tm.nextID,
+		plugin:   p,
+		schedule: schedule,
+		next:     schedule.Next(tm.server.clock.Now()),
+		Runnable: r,
+	}
+	return tm.nextID, true
+}
+
+func (tm *taskManager) unregister(id int) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	delete(tm.tasks, id)
+}
+
+func (tm *taskManager) unregisterPlugin(p api.Plugin) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	for id, t := range tm.tasks {
+		if t.plugin != nil && p != nil && t.plugin.GetName() == p.GetName() {
+			delete(tm.tasks, id)
+		}
+	}
+}
+
+// advance runs due tasks one by one in order of time until target,
+// tasks with the same time are run in order of registration
+func (tm *taskManager) advance(target time.Time) {
+	for {
+		tm.lock.Lock()
+		var due []*task
+		for _, t := range tm.tasks {
+			if !t.next.IsZero() && !t.next.After(target) {
+				due = append(due, t)
+			}
+		}
+		if len(due) == 0 {
+			tm.lock.Unlock()
+			break
+		}
+		sort.Slice(due, func(i, j int) bool {
+			if due[i].next.Equal(due[j].next) {
+				return due[i].id < due[j].id
+			}
+			return due[i].next.Before(due[j].next)
+		})
+		t := due[0]
+		now := t.next
+		t.next = t.schedule.Next(now)
+		tm.lock.Unlock()
+
+		tm.server.clock.Set(now)
+		tm.server.guard(t.plugin, "task", t.Run)
+	}
+	tm.server.clock.Set(target)
+}
+
+// guard recovers panic of f and logs it as the server does
+func (s *Server) guard(p api.Plugin, source string, f func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			name := ""
+			if p != nil {
+				name = p.GetName()
+			}
+			s.logs.log(name, "error", fmt.Sprintf("Recovered from panic in %s: %v", source, r), nil)
+		}
+	}()
+	f()
+	return false
+}
@@ -0,0 +1,157 @@
+package oasistest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+// PredictionThreshold is the same as the server
+const PredictionThreshold = 10
+
+type commandManager struct {
+	server   *Server
+	lock     sync.RWMutex
+	commands map[string]*api.CommandEntry
+}
+
+func newCommandManager(s *Server) *commandManager {
+	return &commandManager{
+		server:   s,
+		commands: map[string]*api.CommandEntry{},
+	}
+}
+
+// excute parses sentence the same as the server. Commands called
+// by a caller which isn't a Plugin are considered from console.
+func (cm *commandManager) excute(caller api.CommandCaller, sentence string) bool {
+	sentence = strings.TrimLeft(sentence, " ")
+	if sentence == "" {
+		return false
+	}
+	p, _ := caller.(api.Plugin)
+
+	args := strings.Split(sentence, " ")
+	command := strings.ToLower(args[0])
+	args = args[1:]
+
+	cm.lock.RLock()
+	c, ok := cm.commands[command]
+	cm.lock.RUnlock()
+	if !ok {
+		cm.server.logs.log("", "info", fmt.Sprintf("Command: %s is not found.", command), nil)
+		return false
+	}
+	if c.Plugin != nil && !c.Plugin.IsEnabled() {
+		cm.server.logs.log("", "info", fmt.Sprintf("Command: %s is disabled with plugin [%s].", command, c.Plugin), nil)
+		return false
+	}
+	cm.server.guard(c.Plugin, "command "+command, func() {
+		c.OnCommand(p, command, args)
+	})
+	return true
+}
+
+func (cm *commandManager) register(command string, p api.Plugin, ce api.CommandExcutor) bool {
+	command = strings.ToLower(command)
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if _, ok := cm.commands[command]; ok {
+		return false
+	}
+	cm.commands[command] = &api.CommandEntry{
+		Command:        command,
+		Plugin:         p,
+		CommandExcutor: ce,
+	}
+	return true
+}
+
+func (cm *commandManager) unregister(command string) bool {
+	command = strings.ToLower(command)
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if _, ok := cm.commands[command]; !ok {
+		return false
+	}
+	delete(cm.commands, command)
+	return true
+}
+
+func (cm *commandManager) unregisterPlugin(p api.Plugin) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	for command, c := range cm.commands {
+		if samePlugin(c.Plugin, p) {
+			delete(cm.commands, command)
+		}
+	}
+}
+
+func (cm *commandManager) prediction(prefix string, force bool) (int, []api.CommandEntry) {
+	list := cm.list(func(c *api.CommandEntry) bool {
+		return strings.HasPrefix(c.Command, prefix)
+	})
+	if len(list) > PredictionThreshold && !force || len(list) == 0 {
+		return len(list), nil
+	}
+	return len(list), list
+}
+
+func (cm *commandManager) pluginCommands(p api.Plugin) []api.CommandEntry {
+	return cm.list(func(c *api.CommandEntry) bool {
+		return samePlugin(c.Plugin, p)
+	})
+}
+
+func (cm *commandManager) list(match func(*api.CommandEntry) bool) []api.CommandEntry {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	var list []api.CommandEntry
+	for _, c := range cm.commands {
+		if match(c) {
+			list = append(list, *c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Command < list[j].Command
+	})
+	return list
+}
+
+func samePlugin(a, b api.Plugin) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.GetName() == b.GetName()
+}
+
+// Execute excutes a command from console, and returns what's printed
+// to os.Stdout by the command
+func (s *Server) Execute(sentence string) (output string, ok bool) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		s.tb.Fatalf("Failed to capture output. Details: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	defer func() {
+		os.Stdout = stdout
+		w.Close()
+		output = <-done
+		r.Close()
+	}()
+	return "", s.ExcuteCommand(nil, sentence)
+}
@@ -0,0 +1,96 @@
+package oasistest
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+	api "github.com/xaxys/oasis/api"
+)
+
+// Config is an in-memory Configuration. Writes are counted
+// instead of written to files.
+type Config struct {
+	*viper.Viper
+	lock    sync.Mutex
+	handles []func()
+	writes  int
+}
+
+// NewConfig returns a Config with defaults and values set from maps,
+// the latter ones override the former ones
+func NewConfig(defaultFields map[string]interface{}, fields ...map[string]interface{}) *Config {
+	c := &Config{Viper: viper.New()}
+	for k, v := range defaultFields {
+		c.SetDefault(k, v)
+	}
+	for _, f := range fields {
+		c.MergeConfigMap(f)
+	}
+	return c
+}
+
+// Update merges fields as if the config file is changed,
+// and runs handles added
+func (c *Config) Update(fields map[string]interface{}) error {
+	if err := c.MergeConfigMap(fields); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	handles := append([]func(){}, c.handles...)
+	c.lock.Unlock()
+	for _, f := range handles {
+		f()
+	}
+	return nil
+}
+
+// Writes returns how many times the config is written
+func (c *Config) Writes() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.writes
+}
+
+func (c *Config) SetAndWrite(key string, value interface{}) error {
+	c.Set(key, value)
+	return c.WriteConfig()
+}
+
+func (c *Config) WriteConfig() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writes++
+	return nil
+}
+
+func (c *Config) SafeWriteConfig() error {
+	return c.WriteConfig()
+}
+
+func (c *Config) UnmarshalKey(key string, rawVal interface{}) error {
+	return c.Viper.UnmarshalKey(key, rawVal)
+}
+
+func (c *Config) Unmarshal(rawVal interface{}) error {
+	return c.Viper.Unmarshal(rawVal)
+}
+
+func (c *Config) SubConfig(key string) api.Configuration {
+	sub := c.Sub(key)
+	if sub == nil {
+		sub = viper.New()
+	}
+	return &Config{Viper: sub}
+}
+
+func (c *Config) AddHandle(f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.handles = append(c.handles, f)
+}
+
+func (c *Config) RemoveAllHandle(f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.handles = nil
+}
@@ -0,0 +1,293 @@
+package oasistest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+var levelRanks = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+// logRecorder keeps all entries logged in memory
+type logRecorder struct {
+	tb          testing.TB
+	clock       *Clock
+	lock        sync.Mutex
+	entries     []api.LogEntry
+	subscribers map[*logSubscription]bool
+}
+
+func newLogRecorder(tb testing.TB, clock *Clock) *logRecorder {
+	return &logRecorder{
+		tb:          tb,
+		clock:       clock,
+		subscribers: map[*logSubscription]bool{},
+	}
+}
+
+func (r *logRecorder) log(plugin string, level string, message string, fields map[string]interface{}) {
+	e := api.LogEntry{
+		Time:    r.clock.Now(),
+		Level:   level,
+		Plugin:  plugin,
+		Message: message,
+		Fields:  fields,
+	}
+	line := strings.ToUpper(level) + " " + message
+	if plugin != "" {
+		line = strings.ToUpper(level) + " [" + plugin + "] " + message
+	}
+	if len(fields) > 0 {
+		line += " " + formatFields(fields)
+	}
+	r.tb.Log(line)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries = append(r.entries, e)
+	for s := range r.subscribers {
+		if !s.match(&e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+func formatFields(fields map[string]interface{}) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	return fmt.Sprint(fields)
+}
+
+// newLogMatcher returns a function reporting whether an entry matches q.
+// Limit is ignored.
+func newLogMatcher(q api.LogQuery) (func(*api.LogEntry) bool, error) {
+	level := 0
+	if q.Level != "" {
+		l, ok := levelRanks[strings.ToLower(q.Level)]
+		if !ok {
+			return nil, fmt.Errorf("unknown log level %q, should be one of debug, info, warn, error", q.Level)
+		}
+		level = l
+	}
+	var pattern *regexp.Regexp
+	if q.Pattern != "" {
+		p, err := regexp.Compile(q.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q. Details: %v", q.Pattern, err)
+		}
+		pattern = p
+	}
+	return func(e *api.LogEntry) bool {
+		if q.Plugin != "" && !strings.EqualFold(e.Plugin, q.Plugin) {
+			return false
+		}
+		if levelRanks[e.Level] < level {
+			return false
+		}
+		if !q.Since.IsZero() && e.Time.Before(q.Since) {
+			return false
+		}
+		if pattern != nil && !pattern.MatchString(e.Message) && !pattern.MatchString(formatFields(e.Fields)) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func (r *logRecorder) query(q api.LogQuery) ([]api.LogEntry, error) {
+	match, err := newLogMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var list []api.LogEntry
+	for i := range r.entries {
+		if match(&r.entries[i]) {
+			list = append(list, r.entries[i])
+		}
+	}
+	if q.Limit > 0 && len(list) > q.Limit {
+		list = list[len(list)-q.Limit:]
+	}
+	return list, nil
+}
+
+func (r *logRecorder) recent(n int) []api.LogEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := r.entries
+	if n > 0 && len(list) > n {
+		list = list[len(list)-n:]
+	}
+	return append([]api.LogEntry{}, list...)
+}
+
+func (r *logRecorder) subscribe(q api.LogQuery, buffer int) (api.LogSubscription, error) {
+	q.Since = time.Time{}
+	match, err := newLogMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &logSubscription{
+		recorder: r,
+		match:    match,
+		ch:       make(chan api.LogEntry, buffer),
+	}
+	r.lock.Lock()
+	r.subscribers[s] = true
+	r.lock.Unlock()
+	return s, nil
+}
+
+type logSubscription struct {
+	recorder *logRecorder
+	match    func(*api.LogEntry) bool
+	ch       chan api.LogEntry
+	dropped  uint64
+}
+
+func (s *logSubscription) C() <-chan api.LogEntry {
+	return s.ch
+}
+
+func (s *logSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *logSubscription) Close() {
+	s.recorder.lock.Lock()
+	defer s.recorder.lock.Unlock()
+	if s.recorder.subscribers[s] {
+		delete(s.recorder.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// Logs returns all entries logged
+func (s *Server) Logs() []api.LogEntry {
+	return s.logs.recent(0)
+}
+
+// ClearLogs drops entries logged
+func (s *Server) ClearLogs() {
+	s.logs.lock.Lock()
+	defer s.logs.lock.Unlock()
+	s.logs.entries = nil
+}
+
+// AssertLogged fails the test if no entry of the level or above
+// matches the regular expression
+func (s *Server) AssertLogged(tb testing.TB, level string, pattern string) {
+	tb.Helper()
+	list, err := s.QueryLogs(api.LogQuery{Level: level, Pattern: pattern})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(list) == 0 {
+		tb.Errorf("No %s log matches %q", level, pattern)
+	}
+}
+
+// AssertNotLogged fails the test if any entry of the level or above
+// matches the regular expression
+func (s *Server) AssertNotLogged(tb testing.TB, level string, pattern string) {
+	tb.Helper()
+	list, err := s.QueryLogs(api.LogQuery{Level: level, Pattern: pattern})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, e := range list {
+		tb.Errorf("Unexpected %s log matches %q: %s", e.Level, pattern, e.Message)
+	}
+}
+
+// pluginLogger records entries of a plugin
+type pluginLogger struct {
+	recorder *logRecorder
+	plugin   string
+}
+
+func (l *pluginLogger) logw(level string, msg string, keysAndValues []interface{}) {
+	var fields map[string]interface{}
+	if len(keysAndValues) > 0 {
+		fields = map[string]interface{}{}
+		for i := 0; i < len(keysAndValues); i += 2 {
+			key := fmt.Sprint(keysAndValues[i])
+			if i+1 < len(keysAndValues) {
+				fields[key] = keysAndValues[i+1]
+			} else {
+				fields[key] = nil
+			}
+		}
+	}
+	l.recorder.log(l.plugin, level, msg, fields)
+}
+
+func (l *pluginLogger) Debug(args ...interface{}) {
+	l.recorder.log(l.plugin, "debug", fmt.Sprint(args...), nil)
+}
+
+func (l *pluginLogger) Debugf(template string, args ...interface{}) {
+	l.recorder.log(l.plugin, "debug", fmt.Sprintf(template, args...), nil)
+}
+
+func (l *pluginLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	l.logw("debug", msg, keysAndValues)
+}
+
+func (l *pluginLogger) Info(args ...interface{}) {
+	l.recorder.log(l.plugin, "info", fmt.Sprint(args...), nil)
+}
+
+func (l *pluginLogger) Infof(template string, args ...interface{}) {
+	l.recorder.log(l.plugin, "info", fmt.Sprintf(template, args...), nil)
+}
+
+func (l *pluginLogger) Infow(msg string, keysAndValues ...interface{}) {
+	l.logw("info", msg, keysAndValues)
+}
+
+func (l *pluginLogger) Warn(args ...interface{}) {
+	l.recorder.log(l.plugin, "warn", fmt.Sprint(args...), nil)
+}
+
+func (l *pluginLogger) Warnf(template string, args ...interface{}) {
+	l.recorder.log(l.plugin, "warn", fmt.Sprintf(template, args...), nil)
+}
+
+func (l *pluginLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.logw("warn", msg, keysAndValues)
+}
+
+func (l *pluginLogger) Error(args ...interface{}) {
+	l.recorder.log(l.plugin, "error", fmt.Sprint(args...), nil)
+}
+
+func (l *pluginLogger) Errorf(template string, args ...interface{}) {
+	l.recorder.log(l.plugin, "error", fmt.Sprintf(template, args...), nil)
+}
+
+func (l *pluginLogger) Errorw(msg string, keysAndValues ...interface{}) {
+	l.logw("error", msg, keysAndValues)
+}
@@ -0,0 +1,105 @@
+package oasistest
+
+import (
+	"strings"
+	"sync"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+// metricsManager keeps values of metrics by name and label values
+type metricsManager struct {
+	lock    sync.Mutex
+	metrics map[string]*metric
+	values  map[string]float64
+}
+
+func newMetricsManager() *metricsManager {
+	return &metricsManager{
+		metrics: map[string]*metric{},
+		values:  map[string]float64{},
+	}
+}
+
+type metric struct {
+	m       *metricsManager
+	plugin  string
+	name    string
+	labels  []string
+	summary bool
+}
+
+func metricName(p api.Plugin, name string) string {
+	if p == nil {
+		return "oasis_" + name
+	}
+	return "oasis_plugin_" + p.GetName() + "_" + name
+}
+
+func metricKey(name string, labelValues []string) string {
+	return name + "{" + strings.Join(labelValues, ",") + "}"
+}
+
+func (mm *metricsManager) newMetric(p api.Plugin, name string, labels []string, summary bool) *metric {
+	name = metricName(p, name)
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	if m, ok := mm.metrics[name]; ok {
+		return m
+	}
+	m := &metric{m: mm, name: name, labels: labels, summary: summary}
+	if p != nil {
+		m.plugin = p.GetName()
+	}
+	mm.metrics[name] = m
+	return m
+}
+
+func (mm *metricsManager) unregisterPlugin(p api.Plugin) {
+	if p == nil {
+		return
+	}
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	for name, m := range mm.metrics {
+		if m.plugin == p.GetName() {
+			delete(mm.metrics, name)
+			for key := range mm.values {
+				if strings.HasPrefix(key, name+"{") || strings.HasPrefix(key, name+"_count{") || strings.HasPrefix(key, name+"_sum{") {
+					delete(mm.values, key)
+				}
+			}
+		}
+	}
+}
+
+func (mm *metricsManager) value(name string, labelValues []string) float64 {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	return mm.values[metricKey(name, labelValues)]
+}
+
+func (m *metric) add(name string, v float64, labelValues []string) {
+	m.m.lock.Lock()
+	defer m.m.lock.Unlock()
+	m.m.values[metricKey(name, labelValues)] += v
+}
+
+func (m *metric) Inc(labelValues ...string) {
+	m.add(m.name, 1, labelValues)
+}
+
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.add(m.name, v, labelValues)
+}
+
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.m.lock.Lock()
+	defer m.m.lock.Unlock()
+	m.m.values[metricKey(m.name, labelValues)] = v
+}
+
+func (m *metric) Observe(v float64, labelValues ...string) {
+	m.add(m.name+"_count", 1, labelValues)
+	m.add(m.name+"_sum", v, labelValues)
+}
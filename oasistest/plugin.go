@@ -0,0 +1,378 @@
+package oasistest
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	api "github.com/xaxys/oasis/api"
+	"github.com/xaxys/oasis/internal/migrate"
+	"github.com/xaxys/oasis/internal/version"
+)
+
+// Plugin runs a UserPlugin through its lifecycle in the same states
+// as the server, but hooks are called without timeout
+type Plugin struct {
+	api.PluginDescription
+	pluginProperty
+	user      api.UserPlugin
+	stateLock sync.Mutex
+	state     api.PluginState
+	history   []api.PluginTransition
+	hookLock  sync.Mutex
+}
+
+func newPlugin(s *Server, up api.UserPlugin, description api.PluginDescription) *Plugin {
+	p := &Plugin{
+		PluginDescription: description,
+		user:              up,
+		state:             api.PluginDiscovered,
+	}
+	p.pluginProperty = pluginProperty{
+		server:  s,
+		this:    p,
+		logger:  &pluginLogger{recorder: s.logs, plugin: description.Name},
+		folder:  filepath.Join(s.dir, description.Name),
+		configs: map[string]api.Configuration{},
+	}
+	return p
+}
+
+// UserPlugin returns the plugin added
+func (p *Plugin) UserPlugin() api.UserPlugin {
+	return p.user
+}
+
+func (p *Plugin) transit(to api.PluginState, reason string) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	p.history = append(p.history, api.PluginTransition{
+		From:   p.state,
+		To:     to,
+		Time:   p.server.clock.Now(),
+		Reason: reason,
+	})
+	p.state = to
+}
+
+func (p *Plugin) fail(err error) {
+	p.transit(api.PluginFailed, err.Error())
+	p.server.UnregisterPluginTask(p)
+	p.server.UnregisterPluginMetrics(p)
+	p.closeDatabase()
+	p.server.logs.log("", "error", fmt.Sprintf("Plugin [%s] failed: %v", p, err), nil)
+}
+
+// runHook calls hook with panic recovered
+func (p *Plugin) runHook(name string, hook func() bool) (res bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v", name, r)
+		}
+	}()
+	return hook(), nil
+}
+
+// Load creates the plugin folder and config, and calls OnLoad.
+// Dependencies must have been loaded.
+func (p *Plugin) Load() bool {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	if p.GetPluginState() != api.PluginDiscovered {
+		return false
+	}
+	for _, d := range p.Dependencies {
+		dp := p.server.GetPlugin(d.Name)
+		if dp == nil || !dp.IsLoaded() {
+			p.transit(api.PluginUnloaded, "dependencies are not loaded")
+			return false
+		}
+		if !version.Match(dp.GetVersion(), d.Version, d.Comparator) {
+			p.server.logs.log("", "warn", fmt.Sprintf("Plugin Dependency not satisfied: [%s] -> [%s version%s%s]. But Found [%s]", p, d.Name, d.Comparator, d.Version, dp), nil)
+		}
+	}
+
+	if err := os.MkdirAll(p.folder, 0755); err != nil {
+		p.fail(err)
+		return false
+	}
+	p.server.lock.RLock()
+	fields := p.server.pluginConfigs[p.Name]
+	p.server.lock.RUnlock()
+	p.config = NewConfig(p.DefaultConfigFields, fields)
+
+	p.user.EntryPoint(&p.pluginProperty)
+	res, err := p.runHook("OnLoad", p.user.OnLoad)
+	if err == nil && !res {
+		err = fmt.Errorf("OnLoad returned false")
+	}
+	if err != nil {
+		p.fail(err)
+		return false
+	}
+	p.transit(api.PluginLoaded, "")
+	return true
+}
+
+func (p *Plugin) Enable() bool {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	if !p.IsLoaded() {
+		return false
+	}
+	state := p.GetPluginState()
+	if state != api.PluginLoaded && state != api.PluginDisabled && state != api.PluginFailed {
+		return false
+	}
+	p.transit(api.PluginEnabling, "")
+	if len(p.DatabaseMigrations) > 0 {
+		db, err := p.GetDatabase()
+		if err == nil {
+			_, err = migrate.Apply(db, "sqlite3", p.DatabaseMigrations)
+		}
+		if err != nil {
+			p.fail(err)
+			return false
+		}
+	}
+	res, err := p.runHook("OnEnable", p.user.OnEnable)
+	if err == nil && !res {
+		err = fmt.Errorf("OnEnable returned false")
+	}
+	if err != nil {
+		p.fail(err)
+		return false
+	}
+	p.transit(api.PluginEnabled, "")
+	return true
+}
+
+func (p *Plugin) Disable() bool {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	if !p.IsEnabled() {
+		return false
+	}
+	p.transit(api.PluginDisabling, "")
+	p.server.UnregisterPluginTask(p)
+	res, err := p.runHook("OnDisable", p.user.OnDisable)
+	if err != nil {
+		p.fail(err)
+		return false
+	}
+	p.server.UnregisterPluginMetrics(p)
+	p.closeDatabase()
+	reason := ""
+	if !res {
+		reason = "OnDisable returned false"
+	}
+	p.transit(api.PluginDisabled, reason)
+	return res
+}
+
+func (p *Plugin) GetName() string {
+	return p.Name
+}
+
+func (p *Plugin) GetVersion() string {
+	return p.Version
+}
+
+func (p *Plugin) GetDescription() string {
+	return p.Description
+}
+
+func (p *Plugin) GetAuthor() string {
+	return p.Author
+}
+
+func (p *Plugin) GetPluginState() api.PluginState {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.state
+}
+
+func (p *Plugin) GetStateHistory() []api.PluginTransition {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return append([]api.PluginTransition{}, p.history...)
+}
+
+func (p *Plugin) IsEnabled() bool {
+	return p.GetPluginState() == api.PluginEnabled
+}
+
+// IsLoaded reports whether p has been loaded,
+// a failed plugin is loaded if it failed after loaded
+func (p *Plugin) IsLoaded() bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	state := p.state
+	if state == api.PluginFailed && len(p.history) > 0 {
+		state = p.history[len(p.history)-1].From
+	}
+	return state != api.PluginDiscovered && state != api.PluginUnloaded && state != api.PluginFailed
+}
+
+func (p *Plugin) IsFailed() bool {
+	return p.GetPluginState() == api.PluginFailed
+}
+
+func (p *Plugin) GetFailure() string {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	if p.state != api.PluginFailed || len(p.history) == 0 {
+		return ""
+	}
+	return p.history[len(p.history)-1].Reason
+}
+
+// GetHealth calls CheckHealth directly if the plugin implements HealthChecker
+func (p *Plugin) GetHealth() api.Health {
+	if p.IsFailed() {
+		return api.Health{Status: api.HealthFailing, Message: p.GetFailure()}
+	}
+	if !p.IsEnabled() {
+		return api.Health{Status: api.HealthUnknown, Message: "plugin is not enabled"}
+	}
+	hc, ok := p.user.(api.HealthChecker)
+	if !ok {
+		return api.Health{Status: api.HealthOK}
+	}
+	var health api.Health
+	if p.server.guard(p, "CheckHealth", func() { health = hc.CheckHealth() }) {
+		return api.Health{Status: api.HealthFailing, Message: "CheckHealth panicked"}
+	}
+	return health
+}
+
+func (p *Plugin) GetDetailedInfo() string {
+	return fmt.Sprintf("[%s] %s %s", p, p.GetPluginState(), p.GetFailure())
+}
+
+func (p *Plugin) GetPluginAPI() interface{} {
+	return p.user.GetPluginAPI()
+}
+
+func (p *Plugin) GetDependencies() []api.PluginDependency {
+	return p.Dependencies
+}
+
+func (p *Plugin) GetSoftDependencies() []api.PluginDependency {
+	return p.SoftDependencies
+}
+
+func (p *Plugin) String() string {
+	return fmt.Sprintf("%s version=%s", p.GetName(), p.GetVersion())
+}
+
+type pluginProperty struct {
+	server *Server
+	this   *Plugin
+	logger api.Logger
+	config *Config
+	folder string
+
+	lock    sync.Mutex
+	configs map[string]api.Configuration
+	storage *memoryStorage
+	db      *sql.DB
+}
+
+func (pp *pluginProperty) GetPlugin() api.Plugin {
+	return pp.this
+}
+
+func (pp *pluginProperty) GetServer() api.Server {
+	return pp.server
+}
+
+func (pp *pluginProperty) GetLogger() api.Logger {
+	return pp.logger
+}
+
+func (pp *pluginProperty) GetConfig() api.Configuration {
+	return pp.config
+}
+
+// Config returns the config of the plugin, which can be updated in tests
+func (pp *pluginProperty) Config() *Config {
+	return pp.config
+}
+
+func (pp *pluginProperty) OpenConfig(file string, defaultFields ...map[string]interface{}) (api.Configuration, error) {
+	if file == "" || filepath.Base(file) != file {
+		return nil, fmt.Errorf("Invalid config file name %q", file)
+	}
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if c, ok := pp.configs[file]; ok {
+		return c, nil
+	}
+	defaults := map[string]interface{}{}
+	for _, fields := range defaultFields {
+		for k, v := range fields {
+			defaults[strings.ToLower(k)] = v
+		}
+	}
+	c := NewConfig(defaults)
+	pp.configs[file] = c
+	return c, nil
+}
+
+func (pp *pluginProperty) GetStorage() (api.Storage, error) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if pp.storage == nil {
+		pp.storage = newMemoryStorage(pp.server.clock)
+	}
+	return pp.storage, nil
+}
+
+// GetDatabase opens a sqlite database in the plugin folder
+func (pp *pluginProperty) GetDatabase() (*sql.DB, error) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if pp.db != nil {
+		return pp.db, nil
+	}
+	if !driverRegistered("sqlite3") {
+		return nil, fmt.Errorf("Driver sqlite3 is not registered, build with cgo or import a sqlite driver in the test")
+	}
+	if err := os.MkdirAll(pp.folder, 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(pp.folder, "database.db")+"?_foreign_keys=1")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	pp.db = db
+	return db, nil
+}
+
+func (pp *pluginProperty) closeDatabase() {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if pp.db != nil {
+		pp.db.Close()
+		pp.db = nil
+	}
+}
+
+func (pp *pluginProperty) GetFolder() string {
+	return pp.folder
+}
+
+// driverRegistered returns true if the driver is imported
+func driverRegistered(driver string) bool {
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+// Package oasistest provides an in-memory Server for testing plugins
+// without the oasis binary. Plugins are added with AddPlugin or Start,
+// their configs are set from maps, logs are captured, tasks are fired by
+// advancing a fake clock, and commands are executed with output captured.
+//
+//	s := oasistest.NewServer(t)
+//	s.SetPluginConfig("whatever", map[string]interface{}{"name": "foo"})
+//	s.Start(t, PLUGIN)
+//	out, _ := s.Execute("hello")
+//	s.Advance(time.Minute)
+//	s.AssertLogged(t, "info", "hello")
+package oasistest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+// Server is a fake Server. It's safe for concurrent use, but Execute
+// redirects os.Stdout and shouldn't be called in parallel tests.
+type Server struct {
+	tb         testing.TB
+	dir        string
+	createTime time.Time
+
+	lock          sync.RWMutex
+	plugins       []*Plugin
+	pluginTable   map[string]*Plugin
+	pluginConfigs map[string]map[string]interface{}
+	formatters    []api.Formatter
+
+	clock    *Clock
+	logs     *logRecorder
+	commands *commandManager
+	tasks    *taskManager
+	metrics  *metricsManager
+}
+
+// NewServer returns a Server whose plugin folders are in a temporary
+// directory removed when the test finishes. Logs are written to tb.Log.
+func NewServer(tb testing.TB) *Server {
+	dir, err := ioutil.TempDir("", "oasistest")
+	if err != nil {
+		tb.Fatalf("Failed to create temporary directory. Details: %v", err)
+	}
+	clock := NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := &Server{
+		tb:            tb,
+		dir:           dir,
+		createTime:    clock.Now(),
+		pluginTable:   map[string]*Plugin{},
+		pluginConfigs: map[string]map[string]interface{}{},
+		clock:         clock,
+		logs:          newLogRecorder(tb, clock),
+		metrics:       newMetricsManager(),
+	}
+	s.commands = newCommandManager(s)
+	s.tasks = newTaskManager(s)
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Close disables enabled plugins in reverse order and removes the
+// temporary directory. It's called when the test finishes.
+func (s *Server) Close() {
+	list := s.GetPlugins()
+	for i := len(list) - 1; i >= 0; i-- {
+		list[i].Disable()
+	}
+	s.lock.RLock()
+	for _, p := range s.plugins {
+		p.closeDatabase()
+	}
+	s.lock.RUnlock()
+	os.RemoveAll(s.dir)
+}
+
+// Dir returns the directory containing plugin folders
+func (s *Server) Dir() string {
+	return s.dir
+}
+
+// Clock returns the clock used by logs, tasks and storages
+func (s *Server) Clock() *Clock {
+	return s.clock
+}
+
+// Advance moves the clock forward by d and runs tasks scheduled
+// in the duration in order
+func (s *Server) Advance(d time.Duration) {
+	s.tasks.advance(s.clock.Now().Add(d))
+}
+
+func (s *Server) GetCreateTime() time.Time {
+	return s.createTime
+}
+
+func (s *Server) RunningTime() time.Duration {
+	return s.clock.Now().Sub(s.createTime)
+}
+
+// SetPluginConfig sets fields of the plugin config, which override
+// DefaultConfigFields. It must be called before the plugin is loaded.
+func (s *Server) SetPluginConfig(name string, fields map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pluginConfigs[name] = fields
+}
+
+// AddPlugin adds a plugin in PluginDiscovered state
+func (s *Server) AddPlugin(up api.UserPlugin) (*Plugin, error) {
+	description := up.GetDescription()
+	if description.Name == "" {
+		return nil, fmt.Errorf("Plugin name is empty")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.pluginTable[description.Name]; ok {
+		return nil, fmt.Errorf("Plugin %s is already added", description.Name)
+	}
+	p := newPlugin(s, up, description)
+	s.plugins = append(s.plugins, p)
+	s.pluginTable[description.Name] = p
+	return p, nil
+}
+
+// Start adds, loads and enables the plugin, and fails the test if any of
+// them fails. Dependencies should be started first.
+func (s *Server) Start(tb testing.TB, up api.UserPlugin) *Plugin {
+	tb.Helper()
+	p, err := s.AddPlugin(up)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !p.Load() {
+		tb.Fatalf("Plugin [%s] unsuccessfully loaded: %s", p, p.GetFailure())
+	}
+	if !p.Enable() {
+		tb.Fatalf("Plugin [%s] unsuccessfully enabled: %s", p, p.GetFailure())
+	}
+	return p
+}
+
+// ConsolePrinter
+
+func (s *Server) RegisterFormatter(f api.Formatter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.formatters = append(s.formatters, f)
+}
+
+func (s *Server) ClearFormatter() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.formatters = nil
+}
+
+// Formatters returns the formatters registered
+func (s *Server) Formatters() []api.Formatter {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]api.Formatter{}, s.formatters...)
+}
+
+// PluginManager
+
+func (s *Server) GetPlugin(name string) api.Plugin {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if p, ok := s.pluginTable[name]; ok {
+		return p
+	}
+	return nil
+}
+
+// GetPlugins equals GetEnabledPlugins
+func (s *Server) GetPlugins() []api.Plugin {
+	return s.GetEnabledPlugins()
+}
+
+func (s *Server) GetEnabledPlugins() []api.Plugin {
+	return s.getPlugins(func(p api.Plugin) bool {
+		return p.IsEnabled()
+	})
+}
+
+func (s *Server) GetDisabledPlugins() []api.Plugin {
+	return s.getPlugins(func(p api.Plugin) bool {
+		return !p.IsEnabled()
+	})
+}
+
+func (s *Server) GetAllPlugins() []api.Plugin {
+	return s.getPlugins(func(api.Plugin) bool {
+		return true
+	})
+}
+
+func (s *Server) GetPluginsByState(state api.PluginState) []api.Plugin {
+	return s.getPlugins(func(p api.Plugin) bool {
+		return p.GetPluginState() == state
+	})
+}
+
+func (s *Server) getPlugins(match func(api.Plugin) bool) []api.Plugin {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var list []api.Plugin
+	for _, p := range s.plugins {
+		if match(p) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// LoadPlugin isn't supported since there are no plugin files,
+// use AddPlugin instead
+func (s *Server) LoadPlugin(names ...string) {
+	s.logs.log("", "warn", fmt.Sprintf("LoadPlugin %v is not supported in oasistest", names), nil)
+}
+
+// LoadPlugins loads and enables plugins added, in order they were added
+func (s *Server) LoadPlugins() {
+	for _, p := range s.GetPluginsByState(api.PluginDiscovered) {
+		if p.Load() {
+			p.Enable()
+		}
+	}
+}
+
+// CommandManager
+
+func (s *Server) ExcuteCommand(caller api.CommandCaller, sentence string) bool {
+	return s.commands.excute(caller, sentence)
+}
+
+func (s *Server) RegisterCommand(command string, p api.Plugin, ce api.CommandExcutor) bool {
+	return s.commands.register(command, p, ce)
+}
+
+func (s *Server) UnregisterCommand(command string) bool {
+	return s.commands.unregister(command)
+}
+
+func (s *Server) UnregisterPluginCommand(p api.Plugin) {
+	s.commands.unregisterPlugin(p)
+}
+
+func (s *Server) GetPrediction(command string, force bool) (int, []api.CommandEntry) {
+	return s.commands.prediction(command, force)
+}
+
+func (s *Server) GetPluginCommands(p api.Plugin) []api.CommandEntry {
+	return s.commands.pluginCommands(p)
+}
+
+// TaskManager
+
+func (s *Server) RegisterTask(p api.Plugin, spec string, r api.Runnable) (int, bool) {
+	return s.tasks.register(p, spec, r)
+}
+
+func (s *Server) UnregisterPluginTask(p api.Plugin) {
+	s.tasks.unregisterPlugin(p)
+}
+
+func (s *Server) UnregisterTask(id int) {
+	s.tasks.unregister(id)
+}
+
+// LogReader
+
+func (s *Server) QueryLogs(q api.LogQuery) ([]api.LogEntry, error) {
+	return s.logs.query(q)
+}
+
+func (s *Server) RecentLogs(n int) []api.LogEntry {
+	return s.logs.recent(n)
+}
+
+func (s *Server) SubscribeLogs(q api.LogQuery, buffer int) (api.LogSubscription, error) {
+	return s.logs.subscribe(q, buffer)
+}
+
+// MetricsManager
+
+func (s *Server) NewCounter(p api.Plugin, name string, help string, labels ...string) api.Counter {
+	return s.metrics.newMetric(p, name, labels, false)
+}
+
+func (s *Server) NewGauge(p api.Plugin, name string, help string, labels ...string) api.Gauge {
+	return s.metrics.newMetric(p, name, labels, false)
+}
+
+func (s *Server) NewSummary(p api.Plugin, name string, help string, labels ...string) api.Summary {
+	return s.metrics.newMetric(p, name, labels, true)
+}
+
+func (s *Server) UnregisterPluginMetrics(p api.Plugin) {
+	s.metrics.unregisterPlugin(p)
+}
+
+// Metric returns the value of a metric, e.g. oasis_plugin_<plugin>_<name>.
+// Summaries have <name>_count and <name>_sum.
+func (s *Server) Metric(name string, labelValues ...string) float64 {
+	return s.metrics.value(name, labelValues)
+}
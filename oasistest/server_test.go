@@ -0,0 +1,265 @@
+package oasistest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+// greeter greets from config, records tasks run and users in database
+type greeter struct {
+	api.PluginBase
+	lock  sync.Mutex
+	ticks []string
+}
+
+func newGreeter(migrations ...api.DatabaseMigration) *greeter {
+	if migrations == nil {
+		migrations = []api.DatabaseMigration{
+			{Version: 1, Description: "create users", SQL: "CREATE TABLE users (name TEXT PRIMARY KEY)"},
+			{Version: 2, Description: "add admin's flag", SQL: "ALTER TABLE users ADD COLUMN admin INTEGER DEFAULT 0"},
+		}
+	}
+	return &greeter{
+		PluginBase: api.PluginBase{
+			PluginDescription: api.PluginDescription{
+				Name:    "greeter",
+				Version: "0.1.0",
+				DefaultConfigFields: map[string]interface{}{
+					"name": "world",
+				},
+				DatabaseMigrations: migrations,
+			},
+		},
+	}
+}
+
+func (g *greeter) OnEnable() bool {
+	name := g.GetConfig().GetString("name")
+	g.GetLogger().Infof("hello %s", name)
+	g.GetConfig().AddHandle(func() {
+		g.GetLogger().Infof("name changed to %s", g.GetConfig().GetString("name"))
+	})
+
+	db, err := g.GetDatabase()
+	if err != nil {
+		g.GetLogger().Error(err)
+		return false
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO users (name, admin) VALUES (?, 1)", name); err != nil {
+		g.GetLogger().Error(err)
+		return false
+	}
+
+	server := g.GetServer()
+	server.RegisterCommand("hello", g.GetPlugin(), g)
+	server.RegisterTask(g.GetPlugin(), "@every 1m", g.tick("minute"))
+	server.RegisterTask(g.GetPlugin(), "@every 30s", g.tick("half"))
+	return true
+}
+
+func (g *greeter) OnDisable() bool {
+	g.GetServer().UnregisterCommand("hello")
+	return true
+}
+
+func (g *greeter) OnCommand(p api.Plugin, command string, args []string) {
+	fmt.Printf("hello %s\n", strings.Join(args, " "))
+}
+
+type taskFunc func()
+
+func (f taskFunc) Run() {
+	f()
+}
+
+func (g *greeter) tick(name string) api.Runnable {
+	return taskFunc(func() {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.ticks = append(g.ticks, name)
+	})
+}
+
+func (g *greeter) getTicks() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]string{}, g.ticks...)
+}
+
+func states(p *Plugin) []api.PluginState {
+	var list []api.PluginState
+	for _, t := range p.GetStateHistory() {
+		list = append(list, t.To)
+	}
+	return list
+}
+
+func assertStates(t *testing.T, p *Plugin, want ...api.PluginState) {
+	t.Helper()
+	if got := states(p); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Plugin went through %v, want %v", got, want)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	s := NewServer(t)
+	s.SetPluginConfig("greeter", map[string]interface{}{"name": "oasis"})
+	p := s.Start(t, newGreeter())
+
+	s.AssertLogged(t, "info", "^hello oasis$")
+	s.AssertNotLogged(t, "info", "hello world")
+
+	if err := p.Config().Update(map[string]interface{}{"name": "xaxys"}); err != nil {
+		t.Fatal(err)
+	}
+	s.AssertLogged(t, "info", "name changed to xaxys")
+	if writes := p.Config().Writes(); writes != 0 {
+		t.Fatalf("Config is written %d times", writes)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	s := NewServer(t)
+	s.Start(t, newGreeter())
+
+	logs := s.Logs()
+	if len(logs) == 0 || logs[len(logs)-1].Plugin != "greeter" {
+		t.Fatalf("Logs of plugin aren't recorded: %v", logs)
+	}
+	s.AssertNotLogged(t, "warn", ".")
+	s.ClearLogs()
+	if logs := s.Logs(); len(logs) != 0 {
+		t.Fatalf("Logs aren't cleared: %v", logs)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	s := NewServer(t)
+	g := newGreeter()
+	start := s.Clock().Now()
+	s.Start(t, g)
+
+	s.Advance(29 * time.Second)
+	if ticks := g.getTicks(); len(ticks) != 0 {
+		t.Fatalf("Tasks run too early: %v", ticks)
+	}
+	s.Advance(91 * time.Second)
+	want := []string{"half", "minute", "half", "half", "minute", "half"}
+	if ticks := g.getTicks(); fmt.Sprint(ticks) != fmt.Sprint(want) {
+		t.Fatalf("Tasks run in %v, want %v", ticks, want)
+	}
+	if now := s.Clock().Now(); !now.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("Clock is %v after advance", now)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	s := NewServer(t)
+	p := s.Start(t, newGreeter())
+
+	out, ok := s.Execute("hello oasis test")
+	if !ok || out != "hello oasis test\n" {
+		t.Fatalf("Execute returned %q, %v", out, ok)
+	}
+	if _, ok := s.Execute("bye"); ok {
+		t.Fatal("Unknown command is executed")
+	}
+
+	p.Disable()
+	if _, ok := s.Execute("hello"); ok {
+		t.Fatal("Command is executed after disabled")
+	}
+}
+
+func TestMigration(t *testing.T) {
+	s := NewServer(t)
+	p := s.Start(t, newGreeter())
+
+	db, err := p.GetDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + api.MigrationTable).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("%d migrations recorded, want 2", count)
+	}
+	var admin int
+	if err := db.QueryRow("SELECT admin FROM users WHERE name = ?", "world").Scan(&admin); err != nil || admin != 1 {
+		t.Fatalf("User isn't inserted after migrations: %v", err)
+	}
+
+	// Applied migrations are skipped when enabled again
+	p.Disable()
+	if !p.Enable() {
+		t.Fatalf("Plugin unsuccessfully enabled again: %s", p.GetFailure())
+	}
+}
+
+func TestStates(t *testing.T) {
+	s := NewServer(t)
+	p := s.Start(t, newGreeter())
+	assertStates(t, p, api.PluginLoaded, api.PluginEnabling, api.PluginEnabled)
+
+	p.Disable()
+	assertStates(t, p, api.PluginLoaded, api.PluginEnabling, api.PluginEnabled, api.PluginDisabling, api.PluginDisabled)
+	if p.IsEnabled() || !p.IsLoaded() {
+		t.Fatalf("Plugin is %s after disabled", p.GetPluginState())
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	s := NewServer(t)
+	p, err := s.AddPlugin(newGreeter(api.DatabaseMigration{Version: 1, SQL: "NOT SQL"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Load() {
+		t.Fatalf("Plugin unsuccessfully loaded: %s", p.GetFailure())
+	}
+	if p.Enable() {
+		t.Fatal("Plugin is enabled with a failed migration")
+	}
+	assertStates(t, p, api.PluginLoaded, api.PluginEnabling, api.PluginFailed)
+	if !p.IsFailed() || !p.IsLoaded() || p.GetFailure() == "" {
+		t.Fatalf("Plugin is %s, failure %q", p.GetPluginState(), p.GetFailure())
+	}
+	s.AssertLogged(t, "error", "greeter.*failed")
+}
+
+func TestMissingDependency(t *testing.T) {
+	s := NewServer(t)
+	g := newGreeter()
+	g.Dependencies = []api.PluginDependency{{Name: "missing", Version: "0.1.0", Comparator: api.ANY}}
+	p, err := s.AddPlugin(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Load() {
+		t.Fatal("Plugin is loaded without its dependency")
+	}
+	assertStates(t, p, api.PluginUnloaded)
+}
+
+func TestDependencyVersion(t *testing.T) {
+	s := NewServer(t)
+	s.Start(t, &api.PluginBase{PluginDescription: api.PluginDescription{Name: "base", Version: "1.10"}})
+
+	g := newGreeter()
+	g.Dependencies = []api.PluginDependency{{Name: "base", Version: "1.9", Comparator: api.GREATER_EQUAL}}
+	s.Start(t, g)
+	s.AssertNotLogged(t, "warn", "not satisfied")
+
+	g = newGreeter()
+	g.Name = "older"
+	g.Dependencies = []api.PluginDependency{{Name: "base", Version: "1.9", Comparator: api.LESS}}
+	s.Start(t, g)
+	s.AssertLogged(t, "warn", `\[older version=0\.1\.0\] -> \[base version<1\.9\]. But Found \[base version=1\.10\]`)
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package oasistest
+
+// GetDatabase opens a sqlite database with this cgo driver. Without cgo,
+// import a pure go driver registered as "sqlite3" in the test instead.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,191 @@
+package oasistest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/xaxys/oasis/api"
+)
+
+type memoryValue struct {
+	value  []byte
+	expire time.Time
+}
+
+// memoryStorage is an in-memory Storage whose keys expire by the clock.
+// Update works on a copy, which replaces the storage if f returns nil.
+type memoryStorage struct {
+	clock   *Clock
+	lock    sync.RWMutex
+	buckets map[string]map[string]memoryValue
+}
+
+func newMemoryStorage(clock *Clock) *memoryStorage {
+	return &memoryStorage{
+		clock:   clock,
+		buckets: map[string]map[string]memoryValue{},
+	}
+}
+
+func (s *memoryStorage) Bucket(name string) api.Bucket {
+	return &storageBucket{s: s, name: name}
+}
+
+func (s *memoryStorage) Buckets() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var list []string
+	for name := range s.buckets {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (s *memoryStorage) DeleteBucket(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.buckets, name)
+	return nil
+}
+
+func (s *memoryStorage) Update(f func(api.StorageTx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	buckets := map[string]map[string]memoryValue{}
+	for name, b := range s.buckets {
+		buckets[name] = map[string]memoryValue{}
+		for k, v := range b {
+			buckets[name][k] = v
+		}
+	}
+	if err := f(&memoryTx{s: s, buckets: buckets, writable: true}); err != nil {
+		return err
+	}
+	s.buckets = buckets
+	return nil
+}
+
+func (s *memoryStorage) View(f func(api.StorageTx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return f(&memoryTx{s: s, buckets: s.buckets})
+}
+
+type memoryTx struct {
+	s        *memoryStorage
+	buckets  map[string]map[string]memoryValue
+	writable bool
+}
+
+func (tx *memoryTx) Bucket(name string) api.Bucket {
+	return &txBucket{tx: tx, name: name}
+}
+
+type txBucket struct {
+	tx   *memoryTx
+	name string
+}
+
+func (b *txBucket) Get(key string) ([]byte, error) {
+	v, ok := b.tx.buckets[b.name][key]
+	if !ok || !v.expire.IsZero() && !v.expire.After(b.tx.s.clock.Now()) {
+		return nil, nil
+	}
+	return append([]byte{}, v.value...), nil
+}
+
+func (b *txBucket) Put(key string, value []byte) error {
+	return b.put(key, value, time.Time{})
+}
+
+func (b *txBucket) PutTTL(key string, value []byte, ttl time.Duration) error {
+	return b.put(key, value, b.tx.s.clock.Now().Add(ttl))
+}
+
+func (b *txBucket) put(key string, value []byte, expire time.Time) error {
+	if !b.tx.writable {
+		return errReadOnly
+	}
+	if b.tx.buckets[b.name] == nil {
+		b.tx.buckets[b.name] = map[string]memoryValue{}
+	}
+	b.tx.buckets[b.name][key] = memoryValue{append([]byte{}, value...), expire}
+	return nil
+}
+
+func (b *txBucket) Delete(key string) error {
+	if !b.tx.writable {
+		return errReadOnly
+	}
+	delete(b.tx.buckets[b.name], key)
+	return nil
+}
+
+func (b *txBucket) ForEach(prefix string, f func(key string, value []byte) error) error {
+	var keys []string
+	for k := range b.tx.buckets[b.name] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, _ := b.Get(k)
+		if value == nil {
+			continue
+		}
+		if err := f(k, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type storageError string
+
+func (e storageError) Error() string {
+	return string(e)
+}
+
+const errReadOnly = storageError("transaction is read-only")
+
+// storageBucket runs every operation in its own transaction
+type storageBucket struct {
+	s    *memoryStorage
+	name string
+}
+
+func (b *storageBucket) Get(key string) (value []byte, err error) {
+	err = b.s.View(func(tx api.StorageTx) error {
+		value, err = tx.Bucket(b.name).Get(key)
+		return err
+	})
+	return
+}
+
+func (b *storageBucket) Put(key string, value []byte) error {
+	return b.s.Update(func(tx api.StorageTx) error {
+		return tx.Bucket(b.name).Put(key, value)
+	})
+}
+
+func (b *storageBucket) PutTTL(key string, value []byte, ttl time.Duration) error {
+	return b.s.Update(func(tx api.StorageTx) error {
+		return tx.Bucket(b.name).PutTTL(key, value, ttl)
+	})
+}
+
+func (b *storageBucket) Delete(key string) error {
+	return b.s.Update(func(tx api.StorageTx) error {
+		return tx.Bucket(b.name).Delete(key)
+	})
+}
+
+func (b *storageBucket) ForEach(prefix string, f func(key string, value []byte) error) error {
+	return b.s.View(func(tx api.StorageTx) error {
+		return tx.Bucket(b.name).ForEach(prefix, f)
+	})
+}
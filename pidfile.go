@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PidFileName is the pidfile in PluginResourcePath if PidFile isn't set
+const PidFileName = "oasis.pid"
+
+// pidFile is locked while the server is running, so that
+// two instances can't run on the same data folder
+type pidFile struct {
+	path string
+	file *os.File
+}
+
+// getPidFilePath returns PidFile in server config, or oasis.pid in
+// PluginResourcePath. It's called before server config is initialized,
+// so that the config file is read without being created, and overrides
+// are looked up directly.
+func getPidFilePath() string {
+	v := offlineServerConfig(filepath.Join(serverConfigDir, ServerConfigName+"."+serverConfigType))
+	get := func(key string) string {
+		if value, ok := flagOverrides["server."+strings.ToLower(key)]; ok {
+			return value
+		}
+		env := EnvPrefix + "_SERVER_" + envName(key)
+		if value, ok := os.LookupEnv(env); ok {
+			return value
+		}
+		if file, ok := os.LookupEnv(env + "_FILE"); ok {
+			if b, err := ioutil.ReadFile(file); err == nil {
+				return strings.TrimRight(string(b), "\r\n")
+			}
+		}
+		return v.GetString(key)
+	}
+	if path := get("PidFile"); path != "" {
+		return path
+	}
+	return filepath.Join(get("PluginResourcePath"), PidFileName)
+}
+
+func acquirePidFile(path string) (*pidFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		return nil, fmt.Errorf("%s is locked by another instance, pid %s. Details: %v", path, strings.TrimSpace(string(b)), err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Sync()
+	return &pidFile{path: path, file: f}, nil
+}
+
+// Release removes the pidfile before unlocking it,
+// so that the pidfile of a new instance won't be removed
+func (p *pidFile) Release() {
+	os.Remove(p.path)
+	p.file.Close()
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// lockFile is not supported on windows, the pidfile is only written
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -1,26 +1,40 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"path/filepath"
 	goplugin "plugin"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/xaxys/oasis/api"
+	"github.com/xaxys/oasis/internal/migrate"
 )
 
 type oasisPlugin struct {
 	PluginDescription
 	pluginProperty
 	UserPlugin
-	goPlugin *goplugin.Plugin
-	enabled  bool
-	loaded   bool
+	goPlugin   *goplugin.Plugin
+	state      PluginState
+	history    []PluginTransition
+	stateLock  sync.Mutex
+	hookLock   sync.Mutex // serializes Load, Enable and Disable
+	health     Health
+	healthLock sync.Mutex
+
+	healthChecking bool // a health check is running
 }
 
 type pluginProperty struct {
-	this   Plugin
-	logger Logger
-	config Configuration
-	folder string
+	this        Plugin
+	logger      Logger
+	config      Configuration
+	folder      string
+	configs     map[string]Configuration
+	configsLock sync.Mutex
 }
 
 func (pp *pluginProperty) GetPlugin() Plugin {
@@ -39,6 +53,54 @@ func (pp *pluginProperty) GetConfig() Configuration {
 	return pp.config
 }
 
+func (pp *pluginProperty) OpenConfig(file string, defaultFields ...map[string]interface{}) (Configuration, error) {
+	if file == "" || filepath.Base(file) != file {
+		return nil, fmt.Errorf("Invalid config file name %q", file)
+	}
+	ext := filepath.Ext(file)
+	name := strings.TrimSuffix(file, ext)
+	configType := strings.TrimPrefix(ext, ".")
+	if configType == "" {
+		configType = ServerConfig.GetString("ConfigType")
+	}
+	if err := checkConfigType(configType); err != nil {
+		return nil, err
+	}
+
+	pp.configsLock.Lock()
+	defer pp.configsLock.Unlock()
+	key := name + "." + configType
+	if c, ok := pp.configs[key]; ok {
+		return c, nil
+	}
+
+	pName := pp.this.GetName()
+	var c Configuration
+	err, _ := initConfig(&c, name, configType, filepath.Join(getConfigPath(), pName), "plugin."+pName+"/"+name, nil, defaultFields...)
+	if err != nil {
+		getLogger().Warn(err)
+		getLogger().Infof("Config %s of [%s] initialized unsuccessfully", key, pp.this)
+	} else {
+		getLogger().Infof("Config %s of [%s] initialized successfully", key, pp.this)
+	}
+	if pp.configs == nil {
+		pp.configs = map[string]Configuration{}
+	}
+	if oc, ok := c.(*oasisConfiguration); ok {
+		oc.owner = pp.this
+	}
+	pp.configs[key] = c
+	return c, nil
+}
+
+func (pp *pluginProperty) GetStorage() (Storage, error) {
+	return getStorage(pp.this.GetName())
+}
+
+func (pp *pluginProperty) GetDatabase() (*sql.DB, error) {
+	return getDatabase(pp.this.GetName())
+}
+
 func (pp *pluginProperty) GetFolder() string {
 	return pp.folder
 }
@@ -54,7 +116,13 @@ func NewPlugin(goPlugin *goplugin.Plugin) (*oasisPlugin, error) {
 		return nil, fmt.Errorf("variable PLUGIN isn't a (*UserPlugin) interface. Found %T", up)
 	}
 
-	description := (*userPlugin).GetDescription()
+	return newPlugin(*userPlugin, goPlugin)
+}
+
+// newPlugin wraps a UserPlugin, goPlugin is nil if it's built-in
+func newPlugin(userPlugin UserPlugin, goPlugin *goplugin.Plugin) (*oasisPlugin, error) {
+
+	description := userPlugin.GetDescription()
 
 	if description.Name == "" {
 		return nil, fmt.Errorf("Plugin name is empty")
@@ -64,54 +132,199 @@ func NewPlugin(goPlugin *goplugin.Plugin) (*oasisPlugin, error) {
 		goPlugin:          goPlugin,
 		PluginDescription: description,
 		pluginProperty:    pluginProperty{},
-		UserPlugin:        *userPlugin,
-		enabled:           false,
-		loaded:            false,
+		UserPlugin:        userPlugin,
+		state:             PluginDiscovered,
 	}
 
 	return p, nil
 }
 
+// IsBuiltin reports whether p is compiled in instead of loaded from file
+func (p *oasisPlugin) IsBuiltin() bool {
+	return p.goPlugin == nil
+}
+
 func (p *oasisPlugin) Load() bool {
-	if p.loaded {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	if p.IsLoaded() || p.GetPluginState() == PluginUnloaded {
 		return false
 	}
 	getLogger().Infof("Loading Plugin [%s]...", p)
 
 	p.folder = CheckFolder(ServerConfig.GetString("PluginResourcePath"), p.GetName())
 	p.logger = GetPluginLogger(p.GetName())
-	p.config = NewConfig(p.GetName(), p.DefaultConfigFields)
 	p.this = p
+	config, err := newPluginConfig(p.GetName(), p.PluginDescription.ConfigType, p.ConfigMigrations, p.DefaultConfigFields)
+	p.config = config
+	if err != nil {
+		p.fail(fmt.Errorf("kept disabled. %v", err))
+		return false
+	}
+
+	if c, ok := config.(*oasisConfiguration); ok {
+		c.owner = p
+	}
 
 	p.EntryPoint(&p.pluginProperty)
-	res := p.OnLoad()
-	p.loaded = true
-	return res
+	res, err := p.runHook("OnLoad", p.OnLoad)
+	if err == nil && !res {
+		err = fmt.Errorf("OnLoad returned false")
+	}
+	if err != nil {
+		p.fail(err)
+		return false
+	}
+	if err := p.transit(PluginLoaded, ""); err != nil {
+		getLogger().Warn(err)
+		return false
+	}
+	return true
 }
 
 func (p *oasisPlugin) Enable() bool {
-	if p.enabled {
+	return p.enable("")
+}
+
+func (p *oasisPlugin) enable(reason string) bool {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	if !p.IsLoaded() {
+		getLogger().Warnf("Plugin [%s] is not loaded, can't be enabled.", p)
+		return false
+	}
+	if err := p.transit(PluginEnabling, reason); err != nil {
+		getLogger().Debug(err)
 		return false
 	}
 	getLogger().Infof("Enabling Plugin [%s]...", p)
 
-	p.enabled = true
-	res := p.OnEnable()
-	return res
+	if err := p.migrateDatabase(); err != nil {
+		p.fail(err)
+		return false
+	}
+	res, err := p.runHook("OnEnable", p.OnEnable)
+	if err == nil && !res {
+		err = fmt.Errorf("OnEnable returned false")
+	}
+	if err != nil {
+		p.fail(err)
+		return false
+	}
+	if err := p.transit(PluginEnabled, ""); err != nil {
+		getLogger().Warn(err)
+		return false
+	}
+	return true
 }
 
 func (p *oasisPlugin) Disable() bool {
-	if !p.enabled || !p.loaded {
+	return p.disable("")
+}
+
+func (p *oasisPlugin) disable(reason string) bool {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	if err := p.transit(PluginDisabling, reason); err != nil {
+		getLogger().Debug(err)
 		return false
 	}
 	getLogger().Infof("Disabling Plugin [%s]...", p)
 	getTaskManager().UnregisterPluginTask(p)
+	p.healthLock.Lock()
+	p.health = Health{}
+	p.healthLock.Unlock()
 
-	p.enabled = true
-	res := p.OnDisable()
+	res, err := p.runHook("OnDisable", p.OnDisable)
+	if err != nil {
+		p.fail(err)
+		return false
+	}
+	getMetricsManager().UnregisterPluginMetrics(p)
+	closeDatabase(p.GetName())
+	reason = ""
+	if !res {
+		reason = "OnDisable returned false"
+	}
+	if err := p.transit(PluginDisabled, reason); err != nil {
+		getLogger().Warn(err)
+		return false
+	}
 	return res
 }
 
+// runHook runs a lifecycle hook with recover and the HookTimeout of p.
+// A timed out hook keeps running in background but is not waited any more.
+func (p *oasisPlugin) runHook(name string, hook func() bool) (bool, error) {
+	type result struct {
+		res      bool
+		panicked bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		r.panicked = guard(p, name, func() {
+			r.res = hook()
+		})
+		done <- r
+	}()
+
+	timeout := getHookTimeout(p)
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case r := <-done:
+		if r.panicked {
+			return false, fmt.Errorf("%s panicked", name)
+		}
+		return r.res, nil
+	case <-deadline:
+		return false, fmt.Errorf("%s timed out after %v", name, timeout)
+	}
+}
+
+// getHookTimeout returns HookTimeout in plugin.yml,
+// or the one in server.yml if it's not set
+func getHookTimeout(p Plugin) time.Duration {
+	key := p.GetName() + ".HookTimeout"
+	if PluginManagerConfig.GetString(key) != "" {
+		return PluginManagerConfig.GetDuration(key)
+	}
+	return ServerConfig.GetDuration("HookTimeout")
+}
+
+// fail marks p as failed with the reason, tasks and metrics of p are
+// unregistered and its commands are refused since it's not enabled any more
+func (p *oasisPlugin) fail(err error) {
+	if terr := p.transit(PluginFailed, err.Error()); terr != nil {
+		getLogger().Warn(terr)
+	}
+	getTaskManager().UnregisterPluginTask(p)
+	getMetricsManager().UnregisterPluginMetrics(p)
+	closeDatabase(p.GetName())
+	getLogger().Errorf("Plugin [%s] failed: %v", p, err)
+}
+
+// migrateDatabase applies DatabaseMigrations of p if there are
+func (p *oasisPlugin) migrateDatabase() error {
+	if len(p.DatabaseMigrations) == 0 {
+		return nil
+	}
+	db, err := getDatabase(p.GetName())
+	if err != nil {
+		return err
+	}
+	count, err := migrate.Apply(db, databaseDriver(p.GetName()), p.DatabaseMigrations)
+	if count > 0 {
+		getLogger().Infof("Applied %d database migrations of [%s]", count, p)
+	}
+	return err
+}
+
 func (p *oasisPlugin) GetName() string {
 	return p.Name
 }
@@ -136,12 +349,21 @@ func (p *oasisPlugin) GetConfig() Configuration {
 	return p.config
 }
 
-func (p *oasisPlugin) IsEnabled() bool {
-	return p.enabled
-}
-
-func (p *oasisPlugin) IsLoaded() bool {
-	return p.loaded
+// GetHealth returns the result of the last health check.
+// It's ok if the plugin isn't a HealthChecker.
+func (p *oasisPlugin) GetHealth() Health {
+	if p.IsFailed() {
+		return Health{Status: HealthFailing, Message: p.GetFailure()}
+	}
+	if !p.IsEnabled() {
+		return Health{Status: HealthUnknown, Message: "plugin is not enabled"}
+	}
+	p.healthLock.Lock()
+	defer p.healthLock.Unlock()
+	if p.health.Status == "" {
+		return Health{Status: HealthOK}
+	}
+	return p.health
 }
 
 func (p *oasisPlugin) GetDependencies() []PluginDependency {
@@ -159,13 +381,19 @@ func (p *oasisPlugin) GetDetailedInfo() string {
 		[Version]: %s
 		[Author]: %s
 		[Description]: %s
-		[Enabled]: %v
+		[Builtin]: %v
+		[State]: %s %s
+		[Health]: %s %s
 	`,
 		p.Name,
 		p.Version,
 		p.Author,
 		p.Description,
-		p.enabled)
+		p.IsBuiltin(),
+		p.GetPluginState(),
+		p.GetFailure(),
+		p.GetHealth().Status,
+		p.GetHealth().Message)
 	return info
 }
 
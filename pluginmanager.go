@@ -15,17 +15,22 @@ import (
 var pluginManagerLock sync.Mutex
 var pluginManager *oasisPluginManager
 
+// oasisPluginManager guards its fields with lock,
+// and loadLock serializes LoadPlugin
 type oasisPluginManager struct {
-	unloadedPlugins []*pluginInfo
-	disabledPlugins []*pluginInfo
-	enabledPlugins  []*pluginInfo
-	pluginTable     map[string]*pluginInfo
-	dependencyMap   map[string][]string
+	lock          sync.RWMutex
+	loadLock      sync.Mutex
+	plugins       []*pluginInfo
+	pluginTable   map[string]*pluginInfo
+	dependencyMap map[string][]string
+	files         map[string]bool
+	ready         bool
 }
 
 type pluginInfo struct {
 	Plugin
 	dependenciesCount int
+	file              string // empty if it's built-in
 }
 
 func (p *pluginInfo) String() string {
@@ -47,6 +52,7 @@ func newPluginManager() *oasisPluginManager {
 	return &oasisPluginManager{
 		pluginTable:   map[string]*pluginInfo{},
 		dependencyMap: map[string][]string{},
+		files:         map[string]bool{},
 	}
 }
 
@@ -56,46 +62,53 @@ func (pm *oasisPluginManager) GetPlugins() []Plugin {
 }
 
 func (pm *oasisPluginManager) GetEnabledPlugins() []Plugin {
-	var list []Plugin
-	pluginManagerLock.Lock()
-	for _, p := range pm.enabledPlugins {
-		list = append(list, p)
-	}
-	pluginManagerLock.Unlock()
-	return list
+	return pm.getPlugins(func(p Plugin) bool {
+		return p.IsEnabled()
+	})
 }
 
 func (pm *oasisPluginManager) GetDisabledPlugins() []Plugin {
-	var list []Plugin
-	pluginManagerLock.Lock()
-	for _, p := range pm.disabledPlugins {
-		list = append(list, p)
-	}
-	pluginManagerLock.Unlock()
-	return list
+	return pm.getPlugins(func(p Plugin) bool {
+		return !p.IsEnabled()
+	})
 }
 
 // GetAllPlugins return a list of enabled and disabled plugins
 func (pm *oasisPluginManager) GetAllPlugins() []Plugin {
+	return pm.getPlugins(func(Plugin) bool {
+		return true
+	})
+}
+
+// GetPluginsByState return a list of plugins in the state
+func (pm *oasisPluginManager) GetPluginsByState(state PluginState) []Plugin {
+	return pm.getPlugins(func(p Plugin) bool {
+		return p.GetPluginState() == state
+	})
+}
+
+// getPlugins return plugins matched in the order they were loaded
+func (pm *oasisPluginManager) getPlugins(match func(Plugin) bool) []Plugin {
 	var list []Plugin
-	pluginManagerLock.Lock()
-	for _, p := range pm.enabledPlugins {
-		list = append(list, p)
-	}
-	for _, p := range pm.disabledPlugins {
-		list = append(list, p)
+	pm.lock.RLock()
+	plugins := pm.plugins
+	pm.lock.RUnlock()
+	for _, p := range plugins {
+		if match(p) {
+			list = append(list, p)
+		}
 	}
-	pluginManagerLock.Unlock()
 	return list
 }
 
 func (pm *oasisPluginManager) GetPlugin(name string) Plugin {
-	pluginManagerLock.Lock()
+	pm.lock.RLock()
 	v, ok := pm.pluginTable[name]
+	pm.lock.RUnlock()
 	if !ok {
 		getLogger().Debugf("Plugin %s is not found", name)
+		return nil
 	}
-	pluginManagerLock.Unlock()
 	return v.Plugin
 }
 
@@ -111,6 +124,9 @@ func (pm *oasisPluginManager) checkPluginFile(name string) (*pluginInfo, error)
 	if _, err := os.Stat(pluginpath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("Plugin file %s is not found. Details: %v", name, err)
 	}
+	pm.lock.Lock()
+	pm.files[name] = true
+	pm.lock.Unlock()
 
 	goplugin, err := goplugin.Open(pluginpath)
 	if err != nil {
@@ -122,53 +138,123 @@ func (pm *oasisPluginManager) checkPluginFile(name string) (*pluginInfo, error)
 		return nil, fmt.Errorf("Plugin file %s isn't a valid oasis plugin. Details: %v", name, err)
 	}
 
+	pinfo, err := pm.addPlugin(p)
+	if err != nil {
+		return nil, fmt.Errorf("Plugin file %s is ignored. %v", name, err)
+	}
+	pinfo.file = name
+	return pinfo, nil
+}
+
+// addPlugin adds p to pluginTable if its name is not taken
+func (pm *oasisPluginManager) addPlugin(p *oasisPlugin) (*pluginInfo, error) {
 	pinfo := &pluginInfo{
-		p,
-		len(p.GetDependencies()),
+		Plugin:            p,
+		dependenciesCount: len(p.GetDependencies()),
 	}
 
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if _, ok := pm.pluginTable[p.GetName()]; ok {
+		return nil, fmt.Errorf("Plugin %s is already loaded", p.GetName())
+	}
 	pm.pluginTable[p.GetName()] = pinfo
 
 	return pinfo, nil
 }
 
+// checkBuiltinPlugins returns plugins registered by api.Register
+// which are not added yet
+func (pm *oasisPluginManager) checkBuiltinPlugins() []*pluginInfo {
+	var list []*pluginInfo
+	for _, up := range RegisteredPlugins() {
+		name := up.GetDescription().Name
+		pm.lock.RLock()
+		_, ok := pm.pluginTable[name]
+		pm.lock.RUnlock()
+		if ok {
+			continue
+		}
+		getLogger().Infof("Checking built-in plugin %s", name)
+		p, err := newPlugin(up, nil)
+		if err == nil {
+			var pinfo *pluginInfo
+			if pinfo, err = pm.addPlugin(p); err == nil {
+				list = append(list, pinfo)
+				continue
+			}
+		}
+		getLogger().Warnf("Built-in plugin %s is ignored. %v", name, err)
+	}
+	return list
+}
+
+// pluginConfigDefault are the fields in PluginManagerConfig configurable by users
+var pluginConfigDefault = map[string]interface{}{
+	"Enable":         true,
+	"LogLevel":       "",
+	"Critical":       false,
+	"PanicPolicy":    PanicIgnore,
+	"MaxRestarts":    5,
+	"RestartBackoff": "1s",
+	"HookTimeout":    "",
+	"DatabaseDriver": "",
+	"DatabaseDSN":    "",
+}
+
 // checkPluginConfig check config to return it's enable statue
 // and generate default plugin configs in PluginManagerConfig
 func (pm *oasisPluginManager) checkPluginConfig(p Plugin) bool {
 	name := p.GetName()
-	enable := true
-	if PluginManagerConfig.IsSet(name + ".Enable") {
-		enable = PluginManagerConfig.GetBool(name + ".Enable")
-	}
-	PluginManagerConfig.Set(name, map[string]interface{}{
-		"Enable":           enable,
+	fields := map[string]interface{}{
 		"Version":          p.GetVersion(),
 		"Description":      p.GetDescription(),
 		"Author":           p.GetAuthor(),
 		"Dependencies":     p.GetDependencies(),
 		"SoftDependencies": p.GetSoftDependencies(),
-	})
-	if err := PluginManagerConfig.WriteConfig(); err != nil {
-		getLogger().Warn(err)
 	}
-	return enable
+	for k, v := range pluginConfigDefault {
+		if PluginManagerConfig.IsSet(name + "." + k) {
+			fields[k] = PluginManagerConfig.Get(name + "." + k)
+		} else {
+			fields[k] = v
+		}
+	}
+	if c, ok := PluginManagerConfig.(*oasisConfiguration); ok {
+		if err := c.setInFile(name, fields); err != nil {
+			getLogger().Warn(err)
+		}
+	} else {
+		PluginManagerConfig.Set(name, fields)
+		if err := PluginManagerConfig.WriteConfig(); err != nil {
+			getLogger().Warn(err)
+		}
+	}
+	return PluginManagerConfig.GetBool(name + ".Enable")
 }
 
 func (pm *oasisPluginManager) LoadPlugin(names ...string) {
+	pm.loadLock.Lock()
+	defer pm.loadLock.Unlock()
+	pm.loadPlugins(pm.checkPluginFiles(names))
+}
 
-	pluginManagerLock.Lock()
-
-	var loadedList []*pluginInfo
+// checkPluginFiles returns valid plugins in files
+func (pm *oasisPluginManager) checkPluginFiles(names []string) []*pluginInfo {
+	var list []*pluginInfo
 	for _, name := range names {
 		if p, err := pm.checkPluginFile(name); err != nil {
 			getLogger().Warn(err)
 		} else {
-			loadedList = append(loadedList, p)
+			list = append(list, p)
 		}
 	}
+	return list
+}
 
-	pluginManagerLock.Unlock()
-
+// loadPlugins resolves dependencies of plugins checked, then loads and
+// enables them in topological order. It must be called with loadLock held.
+func (pm *oasisPluginManager) loadPlugins(loadedList []*pluginInfo) {
 	if len(loadedList) == 0 {
 		return
 	}
@@ -178,7 +264,18 @@ func (pm *oasisPluginManager) LoadPlugin(names ...string) {
 	for _, p := range loadedList {
 		pName := p.GetName()
 		for _, d := range p.GetDependencies() {
+			pm.lock.RLock()
 			dp, ok := pm.pluginTable[d.Name]
+			pm.lock.RUnlock()
+			// Dependencies loaded before are resolved already,
+			// while failed or unloaded ones are never resolved
+			if ok && dp.IsLoaded() {
+				p.dependenciesCount--
+			} else {
+				pm.lock.Lock()
+				pm.dependencyMap[d.Name] = append(pm.dependencyMap[d.Name], pName)
+				pm.lock.Unlock()
+			}
 			if ok {
 				if !Compare(dp.GetVersion(), d.Version, d.Comparator) {
 					unsatisfiedCount++
@@ -190,9 +287,6 @@ func (pm *oasisPluginManager) LoadPlugin(names ...string) {
 				unsatisfiedCount++
 				getLogger().Warnf("Plugin Dependency not satisfied: [%s] -> [%s version%s%s]. [%s] is not found", pName, d.Name, d.Comparator, d.Version, d.Name)
 			}
-			pluginManagerLock.Lock()
-			pm.dependencyMap[d.Name] = append(pm.dependencyMap[d.Name], pName)
-			pluginManagerLock.Unlock()
 		}
 	}
 	getLogger().Infof("Reported %d unsatisfied dependencies", unsatisfiedCount)
@@ -205,37 +299,42 @@ func (pm *oasisPluginManager) LoadPlugin(names ...string) {
 		num = 0
 		var tmpList []*pluginInfo
 		for _, p := range loadedList {
-			if !p.IsLoaded() {
+			if p.GetPluginState() == PluginDiscovered {
 				if p.dependenciesCount == 0 {
 					if p.Load() {
 						getLogger().Infof("Plugin [%s] successfully loaded.", p)
 					} else {
 						getLogger().Warnf("Plugin [%s] unsuccessfully loaded.", p)
 					}
-					if pm.checkPluginConfig(p) {
+					if pm.checkPluginConfig(p) && p.IsLoaded() {
 						if p.Enable() {
 							getLogger().Infof("Plugin [%s] successfully enabled.", p)
 						} else {
 							getLogger().Warnf("Plugin [%s] unsuccessfully enabled.", p)
 						}
-						pluginManagerLock.Lock()
-						pm.enabledPlugins = append(pm.enabledPlugins, p)
-						pluginManagerLock.Unlock()
-					} else {
-						pluginManagerLock.Lock()
-						pm.disabledPlugins = append(pm.disabledPlugins, p)
-						pluginManagerLock.Unlock()
 					}
+					pm.lock.Lock()
+					pm.plugins = append(pm.plugins, p)
+					pm.lock.Unlock()
+					if !p.IsLoaded() {
+						pm.unloadDependents(p.GetName(), fmt.Sprintf("dependency %s failed", p.GetName()))
+						num++
+						continue
+					}
+
+					pm.lock.RLock()
+					var dpList []*pluginInfo
+					for _, dpName := range pm.dependencyMap[p.GetName()] {
+						dpList = append(dpList, pm.pluginTable[dpName])
+					}
+					pm.lock.RUnlock()
 
-					if pList, ok := pm.dependencyMap[p.GetName()]; ok {
-						for _, dpName := range pList {
-							dp := pm.pluginTable[dpName]
-							dp.dependenciesCount--
-							if !dp.IsLoaded() {
-								tmpList = append(tmpList, dp)
-							}
-							getLogger().Debugf("Plugin [%s]'d unloaded dependencies-1, left %d", dp, dp.dependenciesCount)
+					for _, dp := range dpList {
+						dp.dependenciesCount--
+						if dp.GetPluginState() == PluginDiscovered {
+							tmpList = append(tmpList, dp)
 						}
+						getLogger().Debugf("Plugin [%s]'d unloaded dependencies-1, left %d", dp, dp.dependenciesCount)
 					}
 					num++
 				} else {
@@ -249,17 +348,46 @@ func (pm *oasisPluginManager) LoadPlugin(names ...string) {
 		times++
 	}
 
-	pluginManagerLock.Lock()
-	pm.unloadedPlugins = append(pm.unloadedPlugins, loadedList...)
-	pluginManagerLock.Unlock()
+	var unloadedList []*pluginInfo
+	for _, p := range loadedList {
+		if op := toOasisPlugin(p); op != nil && op.transit(PluginUnloaded, "dependencies are not loaded") == nil {
+			unloadedList = append(unloadedList, p)
+		}
+	}
+	pm.lock.Lock()
+	pm.plugins = append(pm.plugins, unloadedList...)
+	pm.lock.Unlock()
 }
 
-func (pm *oasisPluginManager) LoadPlugins() {
+// unloadDependents unloads plugins waiting for the plugin name
+// and their dependents, as it can't be loaded any more
+func (pm *oasisPluginManager) unloadDependents(name string, reason string) {
+	pm.lock.RLock()
+	var dpList []*pluginInfo
+	for _, dpName := range pm.dependencyMap[name] {
+		dpList = append(dpList, pm.pluginTable[dpName])
+	}
+	pm.lock.RUnlock()
+
+	for _, dp := range dpList {
+		op := toOasisPlugin(dp)
+		if op == nil || dp.GetPluginState() != PluginDiscovered || op.transit(PluginUnloaded, reason) != nil {
+			continue
+		}
+		getLogger().Warnf("Plugin [%s] is unloaded, %s", dp, reason)
+		pm.lock.Lock()
+		pm.plugins = append(pm.plugins, dp)
+		pm.lock.Unlock()
+		pm.unloadDependents(dp.GetName(), fmt.Sprintf("dependency %s is unloaded", dp.GetName()))
+	}
+}
+
+// listPluginFiles returns names of plugin files in PluginPath
+func listPluginFiles() ([]string, error) {
 	path := CheckFolder(ServerConfig.GetString("PluginPath"))
 	folder, err := ioutil.ReadDir(path)
 	if err != nil {
-		getLogger().Warnf("Fail to access to PluginPath. Details: %v", err)
-		return
+		return nil, err
 	}
 
 	var pluginList []string
@@ -271,13 +399,121 @@ func (pm *oasisPluginManager) LoadPlugins() {
 			}
 		}
 	}
+	return pluginList, nil
+}
+
+// LoadPlugins loads built-in plugins and plugin files in PluginPath.
+// Built-in plugins take precedence over files with the same plugin name.
+func (pm *oasisPluginManager) LoadPlugins() {
+	pm.loadLock.Lock()
+	builtinList := pm.checkBuiltinPlugins()
+	pluginList, err := listPluginFiles()
+	if err != nil {
+		getLogger().Warnf("Fail to access to PluginPath. Details: %v", err)
+	}
+	pm.loadPlugins(append(builtinList, pm.checkPluginFiles(pluginList)...))
+	pm.loadLock.Unlock()
 
-	pm.LoadPlugin(pluginList...)
+	pm.lock.Lock()
+	pm.ready = true
+	pm.lock.Unlock()
 }
 
-func (pm *oasisPluginManager) Stop() {
+// LoadNewPlugins loads plugin files added to PluginPath after loaded,
+// and returns their names
+func (pm *oasisPluginManager) LoadNewPlugins() []string {
+	pluginList, err := listPluginFiles()
+	if err != nil {
+		getLogger().Warnf("Fail to access to PluginPath. Details: %v", err)
+		return nil
+	}
+
+	var newList []string
+	pm.lock.RLock()
+	for _, name := range pluginList {
+		if !pm.files[name] {
+			newList = append(newList, name)
+		}
+	}
+	pm.lock.RUnlock()
+
+	if len(newList) > 0 {
+		getLogger().Infof("Found %d new plugin files", len(newList))
+		pm.LoadPlugin(newList...)
+	}
+	return newList
+}
+
+// hasPluginFile reports whether the file has been checked
+func (pm *oasisPluginManager) hasPluginFile(name string) bool {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	return pm.files[name]
+}
+
+// getPluginByFile returns the plugin loaded from the file, or nil
+func (pm *oasisPluginManager) getPluginByFile(name string) *pluginInfo {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	for _, p := range pm.pluginTable {
+		if p.file == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// replacePluginFile handles a plugin file changed after checked.
+// A go plugin can't be opened again once loaded, so a restart is needed,
+// but a file failed to open before is checked again.
+func (pm *oasisPluginManager) replacePluginFile(name string) {
+	p := pm.getPluginByFile(name)
+	if p == nil {
+		getLogger().Infof("Plugin file %s is changed, checking it again", name)
+		pm.lock.Lock()
+		delete(pm.files, name)
+		pm.lock.Unlock()
+		pm.LoadPlugin(name)
+		return
+	}
+	getLogger().Warnf("Plugin file %s of [%s] is replaced. Go plugins can't be reloaded, restart the server to use it", name, p)
+}
+
+// removePluginFile disables the plugin loaded from the removed file.
+// It stays in memory until restart, since go plugins can't be unloaded.
+func (pm *oasisPluginManager) removePluginFile(name string) {
+	p := pm.getPluginByFile(name)
+	if p == nil {
+		pm.lock.Lock()
+		delete(pm.files, name)
+		pm.lock.Unlock()
+		getLogger().Infof("Plugin file %s is removed", name)
+		return
+	}
+	getLogger().Warnf("Plugin file %s of [%s] is removed", name, p)
+	if p.IsEnabled() {
+		disablePlugin(p, "plugin file removed")
+	}
+}
+
+// IsReady returns true after LoadPlugins finished
+func (pm *oasisPluginManager) IsReady() bool {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	return pm.ready
+}
+
+// Stop disables enabled plugins in reverse order of loading, so that
+// plugins are disabled before their dependencies.
+// It returns false if some plugins failed to disable.
+func (pm *oasisPluginManager) Stop() bool {
+	ok := true
 	pList := pm.GetPlugins()
-	for _, p := range pList {
-		p.Disable()
+	for i := len(pList) - 1; i >= 0; i-- {
+		p := pList[i]
+		if !disablePlugin(p, "server stopping") && p.IsFailed() {
+			ok = false
+		}
 	}
+	return ok
 }
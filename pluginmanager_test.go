@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// loadFailPlugin fails OnLoad if fail is set
+type loadFailPlugin struct {
+	PluginBase
+	fail bool
+}
+
+func (p *loadFailPlugin) OnLoad() bool {
+	return !p.fail
+}
+
+func addTestPlugin(t *testing.T, name string, fail bool, dependencies ...string) *pluginInfo {
+	up := &loadFailPlugin{fail: fail}
+	up.Name = name
+	up.Version = "0.1.0"
+	for _, d := range dependencies {
+		up.Dependencies = append(up.Dependencies, PluginDependency{Name: d, Version: "0.1.0", Comparator: ANY})
+	}
+	op, err := newPlugin(up, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinfo, err := getPluginManager().addPlugin(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pinfo
+}
+
+func lastReason(p Plugin) string {
+	history := p.GetStateHistory()
+	if len(history) == 0 {
+		return ""
+	}
+	return history[len(history)-1].Reason
+}
+
+func TestLoadPluginsDependencyFailed(t *testing.T) {
+	// c -> b -> a, and a fails OnLoad. d is independent.
+	c := addTestPlugin(t, "depfailc", false, "depfailb")
+	b := addTestPlugin(t, "depfailb", false, "depfaila")
+	a := addTestPlugin(t, "depfaila", true)
+	d := addTestPlugin(t, "depfaild", false)
+
+	pm := getPluginManager()
+	pm.loadLock.Lock()
+	pm.loadPlugins([]*pluginInfo{c, b, a, d})
+	pm.loadLock.Unlock()
+
+	if state := a.GetPluginState(); state != PluginFailed {
+		t.Fatalf("Plugin [%s] is %s, want failed", a, state)
+	}
+	if state := b.GetPluginState(); state != PluginUnloaded {
+		t.Fatalf("Plugin [%s] is %s, want unloaded", b, state)
+	}
+	if reason := lastReason(b); reason != "dependency depfaila failed" {
+		t.Fatalf("Plugin [%s] is unloaded for %q", b, reason)
+	}
+	if state := c.GetPluginState(); state != PluginUnloaded {
+		t.Fatalf("Plugin [%s] is %s, want unloaded", c, state)
+	}
+	if !d.IsEnabled() {
+		t.Fatalf("Plugin [%s] is %s, want enabled", d, d.GetPluginState())
+	}
+
+	// Each plugin is listed once
+	count := map[string]int{}
+	for _, p := range pm.GetAllPlugins() {
+		count[p.GetName()]++
+	}
+	for _, p := range []*pluginInfo{a, b, c, d} {
+		if count[p.GetName()] != 1 {
+			t.Fatalf("Plugin [%s] is listed %d times", p, count[p.GetName()])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// StateHistoryLimit is the number of transitions kept for each plugin
+const StateHistoryLimit = 50
+
+// pluginStates lists plugin states in the order of their lifecycle
+var pluginStates = []PluginState{
+	PluginEnabled,
+	PluginEnabling,
+	PluginDisabling,
+	PluginDisabled,
+	PluginLoaded,
+	PluginFailed,
+	PluginDiscovered,
+	PluginUnloaded,
+}
+
+// pluginTransitions are the valid transitions from each state
+var pluginTransitions = map[PluginState][]PluginState{
+	PluginDiscovered: {PluginLoaded, PluginFailed, PluginUnloaded},
+	PluginLoaded:     {PluginEnabling, PluginUnloaded},
+	PluginEnabling:   {PluginEnabled, PluginFailed},
+	PluginEnabled:    {PluginDisabling, PluginFailed},
+	PluginDisabling:  {PluginDisabled, PluginFailed},
+	PluginDisabled:   {PluginEnabling, PluginUnloaded},
+	PluginFailed:     {PluginLoaded, PluginEnabling, PluginUnloaded},
+	PluginUnloaded:   {},
+}
+
+func canTransit(from, to PluginState) bool {
+	for _, v := range pluginTransitions[from] {
+		if v == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transit changes state of p to the state if the transition is valid,
+// and records it in the history with the reason
+func (p *oasisPlugin) transit(to PluginState, reason string) error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.transitLocked(to, reason)
+}
+
+func (p *oasisPlugin) transitLocked(to PluginState, reason string) error {
+	from := p.state
+	if !canTransit(from, to) {
+		return fmt.Errorf("Plugin [%s] can't be %s when it's %s", p, to, from)
+	}
+	// A failed plugin can only be loaded if it failed before loaded,
+	// and only be enabled if it failed after loaded
+	if from == PluginFailed && to != PluginUnloaded && (to == PluginLoaded) == p.loadedLocked() {
+		return fmt.Errorf("Plugin [%s] can't be %s when it's %s", p, to, from)
+	}
+	p.state = to
+	p.history = append(p.history, PluginTransition{
+		From:   from,
+		To:     to,
+		Time:   time.Now(),
+		Reason: reason,
+	})
+	if len(p.history) > StateHistoryLimit {
+		p.history = p.history[len(p.history)-StateHistoryLimit:]
+	}
+	getLogger().Debugf("Plugin [%s] %s -> %s %s", p, from, to, reason)
+	return nil
+}
+
+// loadedLocked reports whether p has been loaded,
+// a failed plugin is loaded if it failed after loaded
+func (p *oasisPlugin) loadedLocked() bool {
+	state := p.state
+	if state == PluginFailed && len(p.history) > 0 {
+		state = p.history[len(p.history)-1].From
+	}
+	return state != PluginDiscovered && state != PluginUnloaded && state != PluginFailed
+}
+
+func (p *oasisPlugin) GetPluginState() PluginState {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.state
+}
+
+func (p *oasisPlugin) GetStateHistory() []PluginTransition {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return append([]PluginTransition{}, p.history...)
+}
+
+func (p *oasisPlugin) IsEnabled() bool {
+	return p.GetPluginState() == PluginEnabled
+}
+
+func (p *oasisPlugin) IsLoaded() bool {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.loadedLocked()
+}
+
+func (p *oasisPlugin) IsFailed() bool {
+	return p.GetPluginState() == PluginFailed
+}
+
+// GetFailure returns the reason why the plugin failed
+func (p *oasisPlugin) GetFailure() string {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	if p.state != PluginFailed || len(p.history) == 0 {
+		return ""
+	}
+	return p.history[len(p.history)-1].Reason
+}
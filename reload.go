@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// restartKeys are server configs only read at startup
+var restartKeys = []string{
+	"PluginPath",
+	"PluginResourcePath",
+	"ConfigPath",
+	"ConfigType",
+	"DebugMode",
+	"LogBufferSize",
+	"HTTPAddress",
+	"HealthInterval",
+	"WatchPlugins",
+}
+
+// startupValues are values of restartKeys in effect
+var startupValues map[string]interface{}
+
+// recordStartupValues records values of restartKeys at startup
+func recordStartupValues() {
+	startupValues = map[string]interface{}{}
+	for _, key := range restartKeys {
+		startupValues[key] = ServerConfig.Get(key)
+	}
+}
+
+// reloadServer reads server and plugin config again, applies changes
+// that can be applied live, loads new plugin files and returns the
+// changes that require a restart
+func reloadServer() []string {
+	getLogger().Info("Reloading the server...")
+	notifyState("RELOADING=1")
+	defer notifyState("READY=1")
+	for _, config := range []Configuration{ServerConfig, PluginManagerConfig} {
+		if c, ok := config.(*oasisConfiguration); ok {
+			if err := c.reload(); err != nil {
+				getLogger().Warnf("Failed to reload config %s. Details: %v", c.scope, err)
+			}
+		}
+	}
+
+	for _, p := range getPluginManager().GetAllPlugins() {
+		enable := PluginManagerConfig.GetBool(p.GetName() + ".Enable")
+		switch state := p.GetPluginState(); {
+		case enable && (state == PluginLoaded || state == PluginDisabled):
+			enablePlugin(p, "enabled by reload")
+		case !enable && state == PluginEnabled:
+			disablePlugin(p, "disabled by reload")
+		}
+	}
+	getPluginManager().LoadNewPlugins()
+
+	var changes []string
+	for _, key := range restartKeys {
+		if value := ServerConfig.Get(key); !reflect.DeepEqual(startupValues[key], value) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", key, startupValues[key], value))
+		}
+	}
+	if len(changes) > 0 {
+		getLogger().Warnf("Server reloaded, but %d changes require a restart: %v", len(changes), changes)
+	} else {
+		getLogger().Info("Server reloaded")
+	}
+	return changes
+}
@@ -27,7 +27,6 @@ func getServer() *oasisServer {
 
 func newServer() *oasisServer {
 	time := time.Now()
-	initServerConfig()
 	initServerCommands()
 	server := &oasisServer{
 		createTime:     time,
@@ -36,17 +35,26 @@ func newServer() *oasisServer {
 		CommandManager: getCommandManager(),
 		ConsolePrinter: getConsolePrinter(),
 		TaskManager:    getTaskManager(),
+		LogReader:      oasisLogReader{},
+		MetricsManager: getMetricsManager(),
 	}
 	server.wg.Add(1)
+	startHealthCheck()
+	startStorageSweeper()
+	getMetricsManager().StartHTTP()
 	return server
 }
 
 type oasisServer struct {
-	wg sync.WaitGroup
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	exitCode int
 	ConsolePrinter
 	PluginManager
 	CommandManager
 	TaskManager
+	LogReader
+	MetricsManager
 	createTime time.Time
 	running    bool
 }
@@ -65,13 +73,62 @@ func (server *oasisServer) Wait() {
 	server.wg.Wait()
 }
 
+// Stop stops the server once, the teardown is abandoned
+// if it's not finished before ShutdownTimeout
 func (server *oasisServer) Stop() {
-	getLogger().Info("Stopping the server...")
+	server.stopOnce.Do(func() {
+		getLogger().Info("Stopping the server...")
+		notifyState("STOPPING=1")
+		timeout := ServerConfig.GetDuration("ShutdownTimeout")
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		done := make(chan bool, 1)
+		go func() {
+			done <- server.teardown()
+		}()
+		select {
+		case ok := <-done:
+			if !ok {
+				server.exitCode = 1
+			}
+		case <-deadline:
+			getLogger().Errorf("Teardown is not finished in %v, giving up", timeout)
+			server.exitCode = 1
+		}
+
+		getLogger().Debug("Flushing configs and logs...")
+		flushConfigs()
+		getLogger().Debug("Stopping ConsolePrinter...")
+		getConsolePrinter().Stop()
+		syncLogger()
+		server.wg.Done()
+	})
+}
+
+// teardown stops managers, returns false if some plugins
+// are not disabled cleanly
+func (server *oasisServer) teardown() bool {
+	getLogger().Debug("Stopping PluginWatcher...")
+	stopPluginWatcher()
 	getLogger().Debug("Stopping TaskManager...")
 	getTaskManager().Stop()
 	getLogger().Debug("Stopping PluginManager...")
-	getPluginManager().Stop()
-	getLogger().Debug("Stopping ConsolePrinter...")
-	getConsolePrinter().Stop()
-	server.wg.Done()
+	ok := getPluginManager().Stop()
+	getLogger().Debug("Closing storages...")
+	closeStorages()
+	getLogger().Debug("Closing databases...")
+	closeDatabases()
+	getLogger().Debug("Stopping MetricsManager...")
+	getMetricsManager().Stop()
+	return ok
+}
+
+// ExitCode returns non-zero if the server is not stopped cleanly
+func (server *oasisServer) ExitCode() int {
+	return server.exitCode
 }
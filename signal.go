@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ExitForced is the exit code when stopped by a second signal
+const ExitForced = 2
+
+// startSignalHandler stops the server gracefully on SIGINT or SIGTERM,
+// and exits immediately if another one is received while stopping.
+// SIGHUP reloads the server.
+func startSignalHandler() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			getLogger().Info("Received SIGHUP")
+			reloadServer()
+		}
+	}()
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		getLogger().Infof("Received %s, stopping the server. Send again to force exit", sig)
+		go getServer().Stop()
+		sig = <-c
+		getLogger().Errorf("Received %s again, exiting without finishing teardown", sig)
+		getConsolePrinter().Stop()
+		syncLogger()
+		os.Exit(ExitForced)
+	}()
+}
@@ -0,0 +1,9 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+// The default sqlite driver of plugin databases. It's a cgo package, so
+// a server built without cgo leaves it out, and plugins have to set
+// DatabaseDriver to a driver imported in the server, e.g. in builtin.go.
+import _ "github.com/mattn/go-sqlite3"
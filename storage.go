@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StorageFileName is the database file in the plugin folder
+const StorageFileName = "storage.db"
+
+// StorageSweepInterval is how often expired keys are deleted
+const StorageSweepInterval = "@every 1m"
+
+var storagesLock sync.Mutex
+var storages = map[string]*oasisStorage{}
+
+// oasisStorage stores keys of a plugin in a bolt database.
+// Values are prefixed with 8 bytes of the expire time in unix
+// nanoseconds, 0 for keys without ttl.
+type oasisStorage struct {
+	db *bolt.DB
+}
+
+// getStorage opens the storage of the plugin once
+func getStorage(name string) (*oasisStorage, error) {
+	storagesLock.Lock()
+	defer storagesLock.Unlock()
+	if s, ok := storages[name]; ok {
+		return s, nil
+	}
+	folder := CheckFolder(ServerConfig.GetString("PluginResourcePath"), name)
+	db, err := bolt.Open(filepath.Join(folder, StorageFileName), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open storage of %s. Details: %v", name, err)
+	}
+	s := &oasisStorage{db: db}
+	storages[name] = s
+	return s, nil
+}
+
+// closeStorages closes all storages opened
+func closeStorages() {
+	storagesLock.Lock()
+	defer storagesLock.Unlock()
+	for name, s := range storages {
+		if err := s.db.Close(); err != nil {
+			getLogger().Warnf("Failed to close storage of %s. Details: %v", name, err)
+		}
+		delete(storages, name)
+	}
+}
+
+// storageSweeper deletes expired keys in all storages opened
+type storageSweeper struct{}
+
+func (storageSweeper) Run() {
+	storagesLock.Lock()
+	var list []*oasisStorage
+	for _, s := range storages {
+		list = append(list, s)
+	}
+	storagesLock.Unlock()
+	for _, s := range list {
+		if err := s.sweep(time.Now()); err != nil {
+			getLogger().Warnf("Failed to delete expired keys. Details: %v", err)
+		}
+	}
+}
+
+func startStorageSweeper() {
+	getTaskManager().RegisterTask(nil, StorageSweepInterval, storageSweeper{})
+}
+
+func (s *oasisStorage) sweep(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			var expired [][]byte
+			b.ForEach(func(k, v []byte) error {
+				if _, ok := decodeValue(v, now); !ok {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func encodeValue(value []byte, expire time.Time) []byte {
+	b := make([]byte, 8+len(value))
+	if !expire.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(expire.UnixNano()))
+	}
+	copy(b[8:], value)
+	return b
+}
+
+// decodeValue returns a copy of the value, and false if it's expired
+func decodeValue(b []byte, now time.Time) ([]byte, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+	if expire := int64(binary.BigEndian.Uint64(b)); expire != 0 && expire <= now.UnixNano() {
+		return nil, false
+	}
+	return append([]byte{}, b[8:]...), true
+}
+
+func (s *oasisStorage) Bucket(name string) Bucket {
+	return &storageBucket{s: s, name: name}
+}
+
+func (s *oasisStorage) Buckets() ([]string, error) {
+	var list []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			list = append(list, string(name))
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *oasisStorage) DeleteBucket(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(name)); err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *oasisStorage) Update(f func(StorageTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return f(storageTx{tx})
+	})
+}
+
+func (s *oasisStorage) View(f func(StorageTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return f(storageTx{tx})
+	})
+}
+
+type storageTx struct {
+	tx *bolt.Tx
+}
+
+func (t storageTx) Bucket(name string) Bucket {
+	return txBucket{tx: t.tx, name: name}
+}
+
+// txBucket is a bucket in a transaction
+type txBucket struct {
+	tx   *bolt.Tx
+	name string
+}
+
+func (b txBucket) Get(key string) ([]byte, error) {
+	bucket := b.tx.Bucket([]byte(b.name))
+	if bucket == nil {
+		return nil, nil
+	}
+	value, _ := decodeValue(bucket.Get([]byte(key)), time.Now())
+	return value, nil
+}
+
+func (b txBucket) Put(key string, value []byte) error {
+	return b.put(key, value, time.Time{})
+}
+
+func (b txBucket) PutTTL(key string, value []byte, ttl time.Duration) error {
+	return b.put(key, value, time.Now().Add(ttl))
+}
+
+func (b txBucket) put(key string, value []byte, expire time.Time) error {
+	bucket, err := b.tx.CreateBucketIfNotExists([]byte(b.name))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), encodeValue(value, expire))
+}
+
+func (b txBucket) Delete(key string) error {
+	bucket := b.tx.Bucket([]byte(b.name))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (b txBucket) ForEach(prefix string, f func(key string, value []byte) error) error {
+	bucket := b.tx.Bucket([]byte(b.name))
+	if bucket == nil {
+		return nil
+	}
+	now := time.Now()
+	p := []byte(prefix)
+	c := bucket.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if value, ok := decodeValue(v, now); ok {
+			if err := f(string(k), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storageBucket runs every operation in its own transaction
+type storageBucket struct {
+	s    *oasisStorage
+	name string
+}
+
+func (b *storageBucket) Get(key string) (value []byte, err error) {
+	err = b.s.View(func(tx StorageTx) error {
+		value, err = tx.Bucket(b.name).Get(key)
+		return err
+	})
+	return
+}
+
+func (b *storageBucket) Put(key string, value []byte) error {
+	return b.s.Update(func(tx StorageTx) error {
+		return tx.Bucket(b.name).Put(key, value)
+	})
+}
+
+func (b *storageBucket) PutTTL(key string, value []byte, ttl time.Duration) error {
+	return b.s.Update(func(tx StorageTx) error {
+		return tx.Bucket(b.name).PutTTL(key, value, ttl)
+	})
+}
+
+func (b *storageBucket) Delete(key string) error {
+	return b.s.Update(func(tx StorageTx) error {
+		return tx.Bucket(b.name).Delete(key)
+	})
+}
+
+func (b *storageBucket) ForEach(prefix string, f func(key string, value []byte) error) error {
+	return b.s.View(func(tx StorageTx) error {
+		return tx.Bucket(b.name).ForEach(prefix, f)
+	})
+}
+
+// storageRecord is a key in exported storage file
+type storageRecord struct {
+	Value  []byte     `json:"value"`
+	Expire *time.Time `json:"expire,omitempty"`
+}
+
+// Export writes all buckets to file in json
+func (s *oasisStorage) Export(file string) (int, error) {
+	data := map[string]map[string]storageRecord{}
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			records := map[string]storageRecord{}
+			b.ForEach(func(k, v []byte) error {
+				value, ok := decodeValue(v, now)
+				if !ok {
+					return nil
+				}
+				r := storageRecord{Value: value}
+				if expire := int64(binary.BigEndian.Uint64(v)); expire != 0 {
+					t := time.Unix(0, expire)
+					r.Expire = &t
+				}
+				records[string(k)] = r
+				count++
+				return nil
+			})
+			data[string(name)] = records
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return count, ioutil.WriteFile(file, b, 0644)
+}
+
+// Import reads buckets from file exported, existing buckets in
+// file are cleared first if replace is true. It's all or nothing.
+func (s *oasisStorage) Import(file string, replace bool) (int, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	data := map[string]map[string]storageRecord{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return 0, err
+	}
+	count := 0
+	now := time.Now()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for name, records := range data {
+			if replace {
+				if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, r := range records {
+				var expire time.Time
+				if r.Expire != nil {
+					if r.Expire.Before(now) {
+						continue
+					}
+					expire = *r.Expire
+				}
+				if err := bucket.Put([]byte(k), encodeValue(r.Value, expire)); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Stats returns count of keys in each bucket
+func (s *oasisStorage) Stats() (map[string]int, error) {
+	stats := map[string]int{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			stats[string(name)] = b.Stats().KeyN
+			return nil
+		})
+	})
+	return stats, err
+}
+
+var storageCommandExcutor StorageCommandExcutor
+
+type StorageCommandExcutor struct{}
+
+func (StorageCommandExcutor) OnCommand(p Plugin, command string, args []string) {
+	if len(args) == 2 && (args[0] == "l" || args[0] == "list") {
+		if getPluginManager().GetPlugin(args[1]) == nil {
+			fmt.Printf("No such a plugin Named: %s\n", args[1])
+			return
+		}
+		s, err := getStorage(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		stats, err := s.Stats()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var names []string
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("Found %d buckets in storage of %s:\n", len(names), args[1])
+		for _, name := range names {
+			fmt.Printf("\t%s: %d keys\n", name, stats[name])
+		}
+		return
+	}
+	if len(args) >= 2 && (args[0] == "e" || args[0] == "export") {
+		file := filepath.Join(ServerConfig.GetString("PluginResourcePath"), args[1], "storage.json")
+		if len(args) > 2 {
+			file = args[2]
+		}
+		if getPluginManager().GetPlugin(args[1]) == nil {
+			fmt.Printf("No such a plugin Named: %s\n", args[1])
+			return
+		}
+		s, err := getStorage(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		count, err := s.Export(file)
+		if err != nil {
+			fmt.Printf("Failed to export storage of %s. Details: %v\n", args[1], err)
+			return
+		}
+		getLogger().Infof("Exported %d keys of storage of %s to %s", count, args[1], file)
+		return
+	}
+	if len(args) >= 3 && (args[0] == "i" || args[0] == "import") {
+		replace := len(args) > 3 && strings.TrimLeft(args[3], "-") == "replace"
+		if getPluginManager().GetPlugin(args[1]) == nil {
+			fmt.Printf("No such a plugin Named: %s\n", args[1])
+			return
+		}
+		if _, err := os.Stat(args[2]); err != nil {
+			fmt.Println(err)
+			return
+		}
+		s, err := getStorage(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		count, err := s.Import(args[2], replace)
+		if err != nil {
+			fmt.Printf("Failed to import storage of %s. Details: %v\n", args[1], err)
+			return
+		}
+		getLogger().Infof("Imported %d keys to storage of %s from %s", count, args[1], args[2])
+		return
+	}
+
+	fmt.Println("---------------[Storage Usage]---------------")
+	fmt.Println(">>> l[ist] <plugin>	| List buckets and key counts")
+	fmt.Println(">>> e[xport] <plugin> [file]	| Export storage to json file")
+	fmt.Println(">>> i[mport] <plugin> <file> [--replace]	| Import storage from json file")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/xaxys/oasis/api"
+)
+
+// Policies applied to a plugin when it panics
+const (
+	PanicIgnore  = "ignore"
+	PanicDisable = "disable"
+	PanicRestart = "restart"
+)
+
+// PanicRecordLimit is the number of panics kept for each plugin
+const PanicRecordLimit = 20
+
+// MaxRestartBackoff limits the exponential backoff of restarting
+const MaxRestartBackoff = 5 * time.Minute
+
+var supervisorLock sync.Mutex
+var supervisor *oasisSupervisor
+
+// oasisSupervisor records panics in code dispatched by Oasis
+// and applies the panic policy of the plugin owning the code
+type oasisSupervisor struct {
+	lock       sync.Mutex
+	records    map[string][]panicRecord
+	restarts   map[string]int
+	restarting map[string]bool
+}
+
+type panicRecord struct {
+	Time   time.Time
+	Source string
+	Value  interface{}
+	Stack  string
+}
+
+func getSupervisor() *oasisSupervisor {
+	if supervisor == nil {
+		supervisorLock.Lock()
+		if supervisor == nil {
+			supervisor = newSupervisor()
+		}
+		supervisorLock.Unlock()
+	}
+	return supervisor
+}
+
+func newSupervisor() *oasisSupervisor {
+	return &oasisSupervisor{
+		records:    map[string][]panicRecord{},
+		restarts:   map[string]int{},
+		restarting: map[string]bool{},
+	}
+}
+
+// guard runs f and recovers from panic, p is nil if f belongs to server.
+// The panic policy is applied unless source is a lifecycle hook.
+func guard(p Plugin, source string, f func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			getSupervisor().report(p, source, r, string(debug.Stack()))
+		}
+	}()
+	f()
+	return false
+}
+
+func isLifecycleHook(source string) bool {
+	return source == "OnLoad" || source == "OnEnable" || source == "OnDisable"
+}
+
+func (s *oasisSupervisor) report(p Plugin, source string, value interface{}, stack string) {
+	if p == nil {
+		getLogger().Errorw(fmt.Sprintf("Recovered from panic in %s: %v", source, value), "stacktrace", stack)
+		return
+	}
+	name := p.GetName()
+	getLogger().Errorw(fmt.Sprintf("Recovered from panic of [%s] in %s: %v", p, source, value), "plugin", name, "stacktrace", stack)
+
+	s.lock.Lock()
+	records := append(s.records[name], panicRecord{
+		Time:   time.Now(),
+		Source: source,
+		Value:  value,
+		Stack:  stack,
+	})
+	if len(records) > PanicRecordLimit {
+		records = records[len(records)-PanicRecordLimit:]
+	}
+	s.records[name] = records
+	s.lock.Unlock()
+
+	if isLifecycleHook(source) {
+		return
+	}
+	switch getPanicPolicy(p) {
+	case PanicDisable:
+		getLogger().Warnf("Disabling Plugin [%s] for its panic policy", p)
+		go disablePlugin(p, "disabled by panic policy")
+	case PanicRestart:
+		s.restart(p)
+	}
+}
+
+func getPanicPolicy(p Plugin) string {
+	policy := strings.ToLower(PluginManagerConfig.GetString(p.GetName() + ".PanicPolicy"))
+	switch policy {
+	case PanicIgnore, PanicDisable, PanicRestart:
+		return policy
+	default:
+		return PanicIgnore
+	}
+}
+
+// restart restarts p after a backoff doubled every time,
+// and disables it if MaxRestarts is exceeded
+func (s *oasisSupervisor) restart(p Plugin) {
+	name := p.GetName()
+	max := PluginManagerConfig.GetInt(name + ".MaxRestarts")
+	backoff := PluginManagerConfig.GetDuration(name + ".RestartBackoff")
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	s.lock.Lock()
+	if s.restarting[name] {
+		s.lock.Unlock()
+		return
+	}
+	if s.restarts[name] >= max {
+		s.lock.Unlock()
+		getLogger().Errorf("Plugin [%s] has been restarted %d times, disabling it", p, max)
+		go disablePlugin(p, "too many restarts")
+		return
+	}
+	for i := 0; i < s.restarts[name] && backoff < MaxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRestartBackoff {
+		backoff = MaxRestartBackoff
+	}
+	s.restarts[name]++
+	s.restarting[name] = true
+	count := s.restarts[name]
+	s.lock.Unlock()
+
+	getLogger().Warnf("Restarting Plugin [%s] in %v (%d/%d)", p, backoff, count, max)
+	go func() {
+		time.Sleep(backoff)
+		disablePlugin(p, "restarting by panic policy")
+		enablePlugin(p, "restarted by panic policy")
+		s.lock.Lock()
+		s.restarting[name] = false
+		s.lock.Unlock()
+	}()
+}
+
+// ResetRestarts clears the restart count, e.g. when enabled manually
+func (s *oasisSupervisor) ResetRestarts(p Plugin) {
+	s.lock.Lock()
+	delete(s.restarts, p.GetName())
+	s.lock.Unlock()
+}
+
+func (s *oasisSupervisor) GetPanics(p Plugin) []panicRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]panicRecord{}, s.records[p.GetName()]...)
+}
+
+// disablePlugin disables p with the reason recorded in its state history
+func disablePlugin(p Plugin, reason string) bool {
+	if op := toOasisPlugin(p); op != nil {
+		return op.disable(reason)
+	}
+	return p.Disable()
+}
+
+// enablePlugin enables p with the reason recorded in its state history
+func enablePlugin(p Plugin, reason string) bool {
+	if op := toOasisPlugin(p); op != nil {
+		return op.enable(reason)
+	}
+	return p.Enable()
+}
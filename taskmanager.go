@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 	. "github.com/xaxys/oasis/api"
@@ -10,7 +11,9 @@ import (
 var taskManagerLock sync.Mutex
 var taskManager *oasisTaskManager
 
+// oasisTaskManager guards pluginMap with lock
 type oasisTaskManager struct {
+	lock      sync.Mutex
 	taskMap   *cron.Cron
 	pluginMap map[Plugin][]int
 }
@@ -34,31 +37,64 @@ func newTaskManager() *oasisTaskManager {
 	}
 }
 
+// measuredTask records runs and durations of a task,
+// and reports its panic to the supervisor
+type measuredTask struct {
+	plugin Plugin
+	name   string
+	Runnable
+}
+
+func (t measuredTask) Run() {
+	start := time.Now()
+	guard(t.plugin, "task", t.Runnable.Run)
+	getMetricsManager().taskRuns.Inc(t.name)
+	getMetricsManager().taskDurations.Observe(time.Since(start).Seconds(), t.name)
+}
+
 func (tm *oasisTaskManager) RegisterTask(p Plugin, time string, r Runnable) (int, bool) {
-	eid, err := tm.taskMap.AddJob(time, r)
+	name := "[Server]"
+	if p != nil {
+		name = p.GetName()
+	}
+	p = pluginKey(p)
+	eid, err := tm.taskMap.AddJob(time, measuredTask{p, name, r})
 	if err != nil {
 		getLogger().Warnf("Failed to register task for %s. Details: %v", p, err)
 		return 0, false
 	}
 	id := int(eid)
-	taskManagerLock.Lock()
+	tm.lock.Lock()
 	tm.pluginMap[p] = append(tm.pluginMap[p], id)
-	taskManagerLock.Unlock()
+	tm.lock.Unlock()
 	return id, true
 }
 
 func (tm *oasisTaskManager) UnregisterTask(id int) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
 	tm.taskMap.Remove(cron.EntryID(id))
+	for p, ids := range tm.pluginMap {
+		for i, v := range ids {
+			if v == id {
+				tm.pluginMap[p] = append(ids[:i:i], ids[i+1:]...)
+				return
+			}
+		}
+	}
 }
 
 func (tm *oasisTaskManager) UnregisterPluginTask(p Plugin) {
-	taskManagerLock.Lock()
+	p = pluginKey(p)
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
 	for _, id := range tm.pluginMap[p] {
 		tm.taskMap.Remove(cron.EntryID(id))
 	}
-	taskManagerLock.Unlock()
+	delete(tm.pluginMap, p)
 }
 
+// Stop stops scheduling and waits for running tasks
 func (tm *oasisTaskManager) Stop() {
-	tm.taskMap.Stop()
+	<-tm.taskMap.Stop().Done()
 }
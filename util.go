@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 
 	. "github.com/xaxys/oasis/api"
+	"github.com/xaxys/oasis/internal/version"
 )
 
 func CheckFolder(args ...string) string {
@@ -42,23 +43,13 @@ func CheckFile(args ...string) {
 	f.Close()
 }
 
+// compareVersion compares versions by numeric components,
+// and returns -1, 0 or 1
+func compareVersion(a string, b string) int {
+	return version.Compare(a, b)
+}
+
+// Compare reports whether version a satisfies opt against b
 func Compare(a string, b string, opt COMPARATOR) bool {
-	switch opt {
-	case GREATER:
-		return a > b
-	case GREATER_EQUAL:
-		return a >= b
-	case LESS:
-		return a < b
-	case LESS_EQUAL:
-		return a <= b
-	case EQUAL:
-		return a == b
-	case UNEQUAL:
-		return a != b
-	case ANY:
-		return true
-	default:
-		return false
-	}
+	return version.Match(a, b, opt)
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var pluginWatcherLock sync.Mutex
+var pluginWatcher *oasisPluginWatcher
+
+// oasisPluginWatcher watches PluginPath for plugin files. Events of a file
+// are debounced, and the file is handled after its size and modification
+// time stay the same for a debounce interval, so that copying is finished.
+type oasisPluginWatcher struct {
+	watcher  *fsnotify.Watcher
+	debounce time.Duration
+	lock     sync.Mutex
+	pending  map[string]*pendingFile
+	ready    chan *pendingFile
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type pendingFile struct {
+	name  string
+	timer *time.Timer
+	info  os.FileInfo
+}
+
+// startPluginWatcher starts watching PluginPath if WatchPlugins is set
+func startPluginWatcher() {
+	if !ServerConfig.GetBool("WatchPlugins") {
+		return
+	}
+	path := CheckFolder(ServerConfig.GetString("PluginPath"))
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(path)
+	}
+	if err != nil {
+		getLogger().Warnf("Failed to watch PluginPath %s. Details: %v", path, err)
+		return
+	}
+	debounce := ServerConfig.GetDuration("WatchDebounce")
+	if debounce <= 0 {
+		debounce = time.Second
+	}
+	w := &oasisPluginWatcher{
+		watcher:  watcher,
+		debounce: debounce,
+		pending:  map[string]*pendingFile{},
+		ready:    make(chan *pendingFile),
+		done:     make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+
+	pluginWatcherLock.Lock()
+	pluginWatcher = w
+	pluginWatcherLock.Unlock()
+	getLogger().Infof("Watching PluginPath %s for plugin files", path)
+}
+
+// stopPluginWatcher stops the watcher and waits for the file being handled
+func stopPluginWatcher() {
+	pluginWatcherLock.Lock()
+	w := pluginWatcher
+	pluginWatcher = nil
+	pluginWatcherLock.Unlock()
+	if w == nil {
+		return
+	}
+	close(w.done)
+	w.watcher.Close()
+	w.lock.Lock()
+	for _, f := range w.pending {
+		f.timer.Stop()
+	}
+	w.lock.Unlock()
+	w.wg.Wait()
+}
+
+// run handles files one by one, so that plugins are loaded in order
+func (w *oasisPluginWatcher) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case e, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Base(e.Name)
+			if strings.HasSuffix(name, ".so") && e.Op&fsnotify.Chmod != e.Op {
+				getLogger().Debugf("Plugin file %s: %s", name, e.Op)
+				w.schedule(name)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			getLogger().Warnf("Error watching PluginPath. Details: %v", err)
+		case f := <-w.ready:
+			w.check(f)
+		}
+	}
+}
+
+// schedule (re)starts the debounce timer of the file
+func (w *oasisPluginWatcher) schedule(name string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	f, ok := w.pending[name]
+	if !ok {
+		f = &pendingFile{name: name}
+		f.timer = time.AfterFunc(w.debounce, func() {
+			select {
+			case w.ready <- f:
+			case <-w.done:
+			}
+		})
+		w.pending[name] = f
+		return
+	}
+	f.timer.Reset(w.debounce)
+}
+
+// check handles the file if it's removed or unchanged since last check,
+// or waits for another debounce interval
+func (w *oasisPluginWatcher) check(f *pendingFile) {
+	name := f.name
+	info, err := os.Stat(filepath.Join(ServerConfig.GetString("PluginPath"), name))
+	w.lock.Lock()
+	// The timer fired again after f was handled, e.g. reset while
+	// it was sending, and f may be replaced by a new one
+	if w.pending[name] != f {
+		w.lock.Unlock()
+		return
+	}
+	if err == nil && (f.info == nil || f.info.Size() != info.Size() || !f.info.ModTime().Equal(info.ModTime())) {
+		f.info = info
+		f.timer.Reset(w.debounce)
+		w.lock.Unlock()
+		return
+	}
+	delete(w.pending, name)
+	w.lock.Unlock()
+
+	pm := getPluginManager()
+	switch {
+	case os.IsNotExist(err):
+		pm.removePluginFile(name)
+	case err != nil:
+		getLogger().Warnf("Failed to access plugin file %s. Details: %v", name, err)
+	case pm.hasPluginFile(name):
+		pm.replacePluginFile(name)
+	default:
+		getLogger().Infof("Found new plugin file %s", name)
+		pm.LoadPlugin(name)
+	}
+}